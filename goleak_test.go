@@ -1,6 +1,7 @@
 package main
 
 import (
+	"os"
 	"testing"
 
 	"go.uber.org/goleak"
@@ -11,5 +12,8 @@ import (
 // a SOCKS listener goroutine and bidirectional relay goroutines per request, so
 // this guards the HTTP entry point against goroutine leaks.
 func TestMain(m *testing.M) {
+	// The clients and the local test servers share the process wide salt
+	// filter of go-shadowsocks2, which would reject the salts of each other.
+	_ = os.Setenv("SHADOWSOCKS_SF_CAPACITY", "-1")
 	goleak.VerifyTestMain(m)
 }
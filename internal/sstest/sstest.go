@@ -0,0 +1,85 @@
+// Package sstest runs local shadowsocks servers for the tests of the other
+// packages.
+package sstest
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/require"
+)
+
+// firstBytesLen is how many bytes of each connection are reported, enough for
+// the start of the salt and any prefix.
+const firstBytesLen = 8
+
+// StartServer runs a shadowsocks server relaying TCP connections to their
+// target until the test ends, and returns its address. The first bytes of
+// every connection are sent to the returned channel while it has room.
+func StartServer(t testing.TB, cipher, password string) (*net.TCPAddr, <-chan []byte) {
+	ciph, err := core.PickCipher(cipher, []byte{}, password)
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	firstBytes := make(chan []byte, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c, ciph, firstBytes)
+		}
+	}()
+	return l.Addr().(*net.TCPAddr), firstBytes
+}
+
+func serve(c net.Conn, ciph core.Cipher, firstBytes chan<- []byte) {
+	defer func() { _ = c.Close() }()
+	reader := bufio.NewReader(c)
+	if first, err := reader.Peek(firstBytesLen); err == nil {
+		select {
+		case firstBytes <- bytes.Clone(first):
+		default:
+		}
+	}
+	sc := ciph.StreamConn(&bufferedConn{Conn: c, reader: reader})
+	target, err := socks.ReadAddr(sc)
+	if err != nil {
+		return
+	}
+	rc, err := net.Dial("tcp", target.String())
+	if err != nil {
+		return
+	}
+	defer func() { _ = rc.Close() }()
+
+	// Either side closing ends the relay, closing the other one.
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		_, _ = io.Copy(rc, sc)
+		_ = rc.Close()
+		_ = c.Close()
+	})
+	_, _ = io.Copy(sc, rc)
+	_ = rc.Close()
+	_ = c.Close()
+	wg.Wait()
+}
+
+// bufferedConn reads a connection through a reader that already buffered some
+// of its data.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.reader.Read(b) }
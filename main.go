@@ -1,13 +1,16 @@
 package main
 
 import (
+	"ShadowTest/ssproxy"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -52,7 +55,122 @@ func main() {
 		port = "8080"
 	}
 
-	router, err := getRouter(true)
+	if pluginsDir := os.Getenv("PLUGINS_DIR"); pluginsDir != "" {
+		if err := ssproxy.EnableExternalPlugins(pluginsDir); err != nil {
+			log.Fatalf("unable to enable external plugins: %v", err)
+		}
+		log.Infof("External SIP003 plugins enabled from %s", pluginsDir)
+	}
+
+	if names := os.Getenv("IPINFO_PROVIDERS"); names != "" {
+		var custom []ssproxy.IPInfoProvider
+		if baseURL := os.Getenv("IPINFO_SHADOWTEST_URL"); baseURL != "" {
+			custom = append(custom, ssproxy.NewShadowTestProvider(baseURL))
+		}
+		if config := os.Getenv("IPINFO_JSON_PROVIDER"); config != "" {
+			provider := &ssproxy.JSONProvider{}
+			if err := json.Unmarshal([]byte(config), provider); err != nil {
+				log.Fatalf("Invalid IPINFO_JSON_PROVIDER value: %v", err)
+			}
+			custom = append(custom, provider)
+		}
+		providers, err := ssproxy.NewIPInfoProviders(strings.Split(names, ","), custom...)
+		if err != nil {
+			log.Fatalf("Invalid IPINFO_PROVIDERS value '%s': %v", names, err)
+		}
+		ssproxy.SetIPInfoProviders(providers...)
+	}
+
+	cityDB, asnDB := os.Getenv("GEOIP_CITY_DB"), os.Getenv("GEOIP_ASN_DB")
+	if cityDB != "" || asnDB != "" {
+		db, err := ssproxy.OpenGeoIPDatabase(cityDB, asnDB)
+		if err != nil {
+			log.Fatalf("unable to open the GeoIP database: %v", err)
+		}
+		geoIPCtx, stopGeoIP := context.WithCancel(context.Background())
+		defer stopGeoIP()
+		go db.Watch(geoIPCtx, time.Minute)
+		ssproxy.SetGeoIPDatabase(db)
+		log.Info("Exit IPs are enriched from the GeoIP database")
+	}
+
+	if entryLookupURL := os.Getenv("ENTRY_LOOKUP_URL"); entryLookupURL != "" {
+		if entryLookupURL == "ip-api" {
+			entryLookupURL = ssproxy.IPAPIEntryLookupURL
+		}
+		if err := ssproxy.SetEntryLookupURL(entryLookupURL); err != nil {
+			log.Fatalf("Invalid ENTRY_LOOKUP_URL: %v", err)
+		}
+	}
+
+	if err := ssproxy.SetDNSResolver(os.Getenv("DNS_RESOLVER")); err != nil {
+		log.Fatalf("Invalid DNS_RESOLVER value: %v", err)
+	}
+
+	bandwidthLimits := ssproxy.DefaultBandwidthLimits
+	if mode := os.Getenv("BANDWIDTH_TEST"); mode != "" {
+		bandwidthLimits.Mode = ssproxy.BandwidthMode(mode)
+	}
+	if envMaxBytes := os.Getenv("BANDWIDTH_MAX_BYTES"); envMaxBytes != "" {
+		maxBytes, err := strconv.ParseInt(envMaxBytes, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid BANDWIDTH_MAX_BYTES value '%s': %v", envMaxBytes, err)
+		}
+		bandwidthLimits.MaxBytes = maxBytes
+	}
+	if envMaxDuration := os.Getenv("BANDWIDTH_MAX_DURATION"); envMaxDuration != "" {
+		maxDuration, err := time.ParseDuration(envMaxDuration)
+		if err != nil {
+			log.Fatalf("Invalid BANDWIDTH_MAX_DURATION value '%s': %v", envMaxDuration, err)
+		}
+		bandwidthLimits.MaxDuration = maxDuration
+	}
+	if err := ssproxy.SetBandwidthLimits(bandwidthLimits); err != nil {
+		log.Fatalf("Invalid bandwidth test settings: %v", err)
+	}
+
+	ipv4Only := true
+	if envIPv4Only := os.Getenv("IPV4_ONLY"); envIPv4Only != "" {
+		parsed, err := strconv.ParseBool(envIPv4Only)
+		if err != nil {
+			log.Fatalf("Invalid IPV4_ONLY value '%s': %v", envIPv4Only, err)
+		}
+		ipv4Only = parsed
+	}
+
+	if config := os.Getenv("IP_LISTS"); config != "" {
+		var sources []ssproxy.IPListSource
+		if err := json.Unmarshal([]byte(config), &sources); err != nil {
+			log.Fatalf("Invalid IP_LISTS value: %v", err)
+		}
+		classifier, err := ssproxy.NewIPClassifier(sources)
+		if err != nil {
+			log.Fatalf("Invalid IP_LISTS value: %v", err)
+		}
+		refresh := 6 * time.Hour
+		if envRefresh := os.Getenv("IP_LISTS_REFRESH"); envRefresh != "" {
+			refresh, err = time.ParseDuration(envRefresh)
+			if err != nil || refresh <= 0 {
+				log.Fatalf("Invalid IP_LISTS_REFRESH value '%s'", envRefresh)
+			}
+		}
+		listsCtx, stopLists := context.WithCancel(context.Background())
+		defer stopLists()
+		go classifier.Run(listsCtx, refresh)
+		ssproxy.SetIPClassifier(classifier)
+		log.Infof("Exit IPs are classified against %d IP lists", len(sources))
+	}
+
+	trustForwardedFor := false
+	if envTrust := os.Getenv("TRUST_X_FORWARDED_FOR"); envTrust != "" {
+		parsed, err := strconv.ParseBool(envTrust)
+		if err != nil {
+			log.Fatalf("Invalid TRUST_X_FORWARDED_FOR value '%s': %v", envTrust, err)
+		}
+		trustForwardedFor = parsed
+	}
+
+	router, err := getRouter(ipv4Only, trustForwardedFor)
 	if err != nil {
 		log.Fatal(err)
 	}
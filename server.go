@@ -11,8 +11,10 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -25,17 +27,78 @@ const ContentType = "Content-Type"
 // ContentTypeJson is the value for ContentType header when the content is JSON
 const ContentTypeJson = "application/json"
 
-const IPInfoTestURL = "https://ip.r4bbit.net/health"
-
 var offlineCache offlinecache.SafeIsOfflineCache
 
 type proxyJson struct {
-	Address string `json:"address"`
+	Address string `json:"address,omitempty"`
 	Timeout int    `json:"timeout,omitempty"`
+	// The key can also be given with the fields of shadowsocks-libev's
+	// config.json instead of an address.
+	ssproxy.KeyConfig
+	ssproxy.Options
+}
+
+// keyTarget describes the tested key in messages, without its credentials. It
+// is HTML escaped as it is echoed back to the client.
+func (p proxyJson) keyTarget() string {
+	if p.Address != "" {
+		return html.EscapeString(redactAddress(p.Address))
+	}
+	return html.EscapeString(net.JoinHostPort(p.Server, p.ServerPort.String()))
+}
+
+// redactAddress removes the credentials of a key address: the user info and
+// query of ss:// keys, legacy keys entirely as their server is encoded with
+// the password, and everything but the host of config URLs, whose path
+// usually holds the secret of the key. Addresses that cannot be parsed are
+// replaced as a whole.
+func redactAddress(address string) string {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "[redacted]"
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "ss":
+		if u.User == nil {
+			return "ss://redacted"
+		}
+		u.User = url.User("redacted")
+		u.RawQuery = ""
+	case "ssconf", "https":
+		u.User = nil
+		u.Path, u.RawPath = "/redacted", ""
+		u.RawQuery = ""
+	default:
+		return "[redacted]"
+	}
+	return u.String()
+}
+
+// getDetails tests the address or the structured key of the request. Requests
+// without an address family only test IPv4 when ipv4Only is set.
+func (p proxyJson) getDetails(ipv4Only bool) (ssproxy.ProxyDetails, error) {
+	var key ssproxy.Key
+	var err error
+	if p.Address != "" {
+		key, err = ssproxy.ResolveKey(p.Address, p.Timeout)
+	} else {
+		key, err = p.Key()
+	}
+	if err != nil {
+		return ssproxy.ProxyDetails{}, err
+	}
+	options := p.Options
+	if options.Family == ssproxy.FamilyAny && ipv4Only {
+		options.Family = ssproxy.FamilyIPv4
+	}
+	return ssproxy.GetShadowsocksKeyDetails(key, p.Timeout, options)
 }
 
 type errorResponse struct {
 	Error string `json:"error"`
+	// Stage and Code identify the failing step of the test, see ssproxy.StageError.
+	Stage string `json:"stage,omitempty"`
+	Code  string `json:"code,omitempty"`
 }
 
 type version struct {
@@ -49,7 +112,9 @@ var indexFile embed.FS
 //go:embed favicon.ico
 var faviconFile embed.FS
 
-func getRouter(ipv4Only bool) (*http.ServeMux, error) {
+// getRouter returns the routes of the service. The IP echo endpoint reads the
+// client from X-Forwarded-For when trustForwardedFor is set.
+func getRouter(ipv4Only, trustForwardedFor bool) (*http.ServeMux, error) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/v1/test", func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Deprecated endpoint. Use v3 instead.", http.StatusNotFound)
@@ -66,25 +131,25 @@ func getRouter(ipv4Only bool) (*http.ServeMux, error) {
 			return
 		}
 
-		if ssproxy.IsIPInfoOffline(&offlineCache, IPInfoTestURL) {
-			err := errors.New("unable to reach ip.r4bbit.net")
-			log.Error("We are facing issues reaching ip.r4bbit.net")
+		if ssproxy.IsIPInfoOffline(&offlineCache, ssproxy.IPInfoHealthURLs()...) {
+			err := errors.New("unable to reach any IP info provider")
+			log.Error("We are facing issues reaching the IP info providers")
 			sentry.CaptureException(err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
-		address, timeout, err := getAddressAndTimeout(r)
+		input, err := getAddressAndTimeout(r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		details, err := ssproxy.GetShadowsocksProxyDetails(address, ipv4Only, timeout)
+		details, err := input.getDetails(ipv4Only)
 		testsTotal.Inc()
 		if err != nil {
 			failuresTotal.Inc()
-			fillCheckError(w, err, address)
+			fillCheckError(w, err, input.keyTarget())
 			return
 		}
 
@@ -97,6 +162,42 @@ func getRouter(ipv4Only bool) (*http.ServeMux, error) {
 		}
 	})
 
+	mux.HandleFunc("/v3/parse", func(w http.ResponseWriter, r *http.Request) {
+		defer closeBody(r)
+		if r.Method != "POST" {
+			http.Error(w, "Method is not supported.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		input, err := getKeyInput(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var report ssproxy.KeyReport
+		if input.Address != "" {
+			report = ssproxy.LintAddress(input.Address)
+		} else {
+			key, err := input.Key()
+			if err != nil {
+				report = ssproxy.KeyReport{Error: err.Error(), Warnings: []ssproxy.KeyWarning{}}
+			} else {
+				report = ssproxy.LintKey(key)
+			}
+		}
+
+		w.Header().Set(ContentType, ContentTypeJson)
+		err = json.NewEncoder(w).Encode(report)
+
+		if err != nil {
+			log.Errorf("error occurred when sending the data back to the client %v", err)
+			sentry.CaptureException(err)
+		}
+	})
+
+	mux.Handle("/v3/ip", ssproxy.IPEchoHandler(trustForwardedFor))
+
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set(ContentType, "text/plain")
 		_, _ = w.Write([]byte("ok"))
@@ -129,6 +230,11 @@ func fillCheckError(w http.ResponseWriter, err error, address string) {
 	}
 
 	response := errorResponse{Error: message}
+	var stageErr *ssproxy.StageError
+	if errors.As(err, &stageErr) {
+		response.Stage = string(stageErr.Stage)
+		response.Code = stageErr.Code
+	}
 	w.Header().Set(ContentType, ContentTypeJson)
 	err = json.NewEncoder(w).Encode(response)
 
@@ -150,59 +256,115 @@ func closeBody(r *http.Request) {
 	}(r.Body)
 }
 
-func getAddressAndTimeout(r *http.Request) (string, int, error) {
-	address := ""
-	timeout := 0
+// getKeyInput reads the address or the structured key of the request as sent.
+func getKeyInput(r *http.Request) (proxyJson, error) {
+	var input proxyJson
 	var err error
 
 	if r.Header.Get(ContentType) == ContentTypeJson {
-		address, timeout, err = getAddressAndTimeoutFromJSON(r)
+		input, err = getAddressAndTimeoutFromJSON(r)
 	} else {
-		address, timeout, err = getAddressAndTimeoutFromForm(r)
+		input, err = getAddressAndTimeoutFromForm(r)
 	}
 
 	if err != nil {
-		return "", 0, err
+		return proxyJson{}, err
 	}
-	if address == "" {
-		return "", 0, fmt.Errorf("missing address in the request")
+	if input.Address == "" && input.Server == "" {
+		return proxyJson{}, fmt.Errorf("missing address in the request")
+	}
+	return input, nil
+}
+
+func getAddressAndTimeout(r *http.Request) (proxyJson, error) {
+	input, err := getKeyInput(r)
+	if err != nil {
+		return proxyJson{}, err
+	}
+	if err := input.Family.Validate(); err != nil {
+		return proxyJson{}, err
+	}
+	if input.Address == "" {
+		if _, err := input.Key(); err != nil {
+			return proxyJson{}, fmt.Errorf("invalid key: %v", err)
+		}
 	}
 
-	if timeout <= 0 {
-		timeout, err = getDefaultTimeout()
+	if input.Timeout <= 0 {
+		input.Timeout, err = getDefaultTimeout()
 		if err != nil {
 			log.Errorf("unable to get default timeout: %v", err)
 			sentry.CaptureException(err)
-			return "", 0, fmt.Errorf("unable to get default timeout: %v", err)
+			return proxyJson{}, fmt.Errorf("unable to get default timeout: %v", err)
 		}
 	}
 
-	return address, timeout, nil
+	return input, nil
 }
 
-func getAddressAndTimeoutFromForm(r *http.Request) (string, int, error) {
+func getAddressAndTimeoutFromForm(r *http.Request) (proxyJson, error) {
 	if err := r.ParseForm(); err != nil {
-		return "", 0, fmt.Errorf("unable to parse request data")
+		return proxyJson{}, fmt.Errorf("unable to parse request data")
 	}
-	address := html.EscapeString(r.FormValue("address"))
+	input := proxyJson{Address: r.FormValue("address")}
+	input.Family = ssproxy.Family(r.FormValue("family"))
 	if r.FormValue("timeout") != "" {
 		timeout, err := strconv.Atoi(r.FormValue("timeout"))
 		if err != nil {
-			return "", 0, fmt.Errorf("unable to parse timeout")
+			return proxyJson{}, fmt.Errorf("unable to parse timeout")
 		}
-		return address, timeout, nil
+		input.Timeout = timeout
+	}
+	udp, err := formBool(r, "udp")
+	if err != nil {
+		return proxyJson{}, err
+	}
+	if udp {
+		input.UDP = &ssproxy.UDPOptions{}
+	}
+	bandwidth, err := formBool(r, "bandwidth")
+	if err != nil {
+		return proxyJson{}, err
+	}
+	if bandwidth {
+		input.Bandwidth = &ssproxy.BandwidthOptions{}
+	}
+	dns, err := formBool(r, "dns")
+	if err != nil {
+		return proxyJson{}, err
+	}
+	if dns {
+		input.DNS = &ssproxy.DNSOptions{}
+	}
+	if r.FormValue("samples") != "" {
+		samples, err := strconv.Atoi(r.FormValue("samples"))
+		if err != nil {
+			return proxyJson{}, fmt.Errorf("unable to parse samples")
+		}
+		input.Samples = &ssproxy.SampleOptions{Count: samples}
+	}
+	return input, nil
+}
+
+// formBool reads an optional boolean form field.
+func formBool(r *http.Request, name string) (bool, error) {
+	if r.FormValue(name) == "" {
+		return false, nil
+	}
+	value, err := strconv.ParseBool(r.FormValue(name))
+	if err != nil {
+		return false, fmt.Errorf("unable to parse %s", name)
 	}
-	return address, 0, nil
+	return value, nil
 }
 
-func getAddressAndTimeoutFromJSON(r *http.Request) (string, int, error) {
+func getAddressAndTimeoutFromJSON(r *http.Request) (proxyJson, error) {
 	p := proxyJson{}
 	err := json.NewDecoder(r.Body).Decode(&p)
 	if err != nil {
-		return "", 0, err
+		return proxyJson{}, err
 	}
-	address := html.EscapeString(p.Address)
-	return address, p.Timeout, nil
+	return p, nil
 }
 
 func getDefaultTimeout() (int, error) {
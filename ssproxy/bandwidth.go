@@ -0,0 +1,254 @@
+package ssproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultBandwidthDownloadURL receives the number of bytes to download in
+	// its bytes parameter.
+	DefaultBandwidthDownloadURL = "https://speed.cloudflare.com/__down"
+	DefaultBandwidthUploadURL   = "https://speed.cloudflare.com/__up"
+
+	defaultBandwidthBytes    = 2 * 1024 * 1024
+	defaultBandwidthDuration = 10 * time.Second
+)
+
+// BandwidthMode selects the bandwidth tests the server runs.
+type BandwidthMode string
+
+const (
+	// BandwidthOff refuses every bandwidth test.
+	BandwidthOff BandwidthMode = "off"
+	// BandwidthDefaultURLs only transfers to and from the default URLs.
+	BandwidthDefaultURLs BandwidthMode = "default"
+	// BandwidthCustomURLs also transfers to and from the URLs of the requests.
+	BandwidthCustomURLs BandwidthMode = "custom"
+)
+
+// BandwidthLimits bounds the bandwidth tests callers can request.
+type BandwidthLimits struct {
+	Mode BandwidthMode
+	// MaxBytes caps the size of each transfer.
+	MaxBytes int64
+	// MaxDuration caps the time of each transfer.
+	MaxDuration time.Duration
+}
+
+// DefaultBandwidthLimits only allows the default URLs, with transfers of at
+// most 10 MiB and 15 seconds.
+var DefaultBandwidthLimits = BandwidthLimits{
+	Mode:        BandwidthDefaultURLs,
+	MaxBytes:    10 * 1024 * 1024,
+	MaxDuration: 15 * time.Second,
+}
+
+var (
+	bandwidthLimitsMu sync.Mutex
+	bandwidthLimits   = DefaultBandwidthLimits
+)
+
+// SetBandwidthLimits bounds the bandwidth tests of the next requests.
+func SetBandwidthLimits(limits BandwidthLimits) error {
+	switch limits.Mode {
+	case BandwidthOff, BandwidthDefaultURLs, BandwidthCustomURLs:
+	default:
+		return fmt.Errorf("unknown bandwidth mode %q", limits.Mode)
+	}
+	if limits.MaxBytes <= 0 || limits.MaxDuration <= 0 {
+		return errors.New("the bandwidth limits must be positive")
+	}
+	bandwidthLimitsMu.Lock()
+	defer bandwidthLimitsMu.Unlock()
+	bandwidthLimits = limits
+	return nil
+}
+
+func getBandwidthLimits() BandwidthLimits {
+	bandwidthLimitsMu.Lock()
+	defer bandwidthLimitsMu.Unlock()
+	return bandwidthLimits
+}
+
+// BandwidthOptions configures the bandwidth test. The download is always
+// measured, the upload only when UploadBytes is set.
+type BandwidthOptions struct {
+	// DownloadURL is requested as is, only DownloadBytes bytes of its body are
+	// read.
+	DownloadURL   string `json:"download_url,omitempty"`
+	DownloadBytes int64  `json:"download_bytes,omitempty"`
+	// UploadURL receives UploadBytes bytes in a POST request.
+	UploadURL   string `json:"upload_url,omitempty"`
+	UploadBytes int64  `json:"upload_bytes,omitempty"`
+	// MaxDuration is the longest each transfer may take, in seconds.
+	MaxDuration int `json:"max_duration,omitempty"`
+}
+
+// BandwidthResult is the outcome of the bandwidth test.
+type BandwidthResult struct {
+	Download *TransferResult `json:"download"`
+	Upload   *TransferResult `json:"upload,omitempty"`
+}
+
+// TransferResult describes one transfer through the tunnel. BytesPerSecond is
+// measured from the first byte of the response on downloads, and from the end
+// of the request headers to the first byte of the response on uploads. Transfers cut by MaxDuration report the bytes moved until
+// then along with the error.
+type TransferResult struct {
+	Bytes          int64   `json:"bytes"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	TTFB           float64 `json:"ttfb_ms"`
+	Duration       float64 `json:"duration_ms"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// zeroReader is an endless source of upload data.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+// withDefaults fills the unset options and caps the transfers to the limits.
+func (o BandwidthOptions) withDefaults(limits BandwidthLimits) BandwidthOptions {
+	if o.DownloadBytes <= 0 {
+		o.DownloadBytes = defaultBandwidthBytes
+	}
+	o.DownloadBytes = min(o.DownloadBytes, limits.MaxBytes)
+	o.UploadBytes = min(max(o.UploadBytes, 0), limits.MaxBytes)
+	if o.DownloadURL == "" {
+		o.DownloadURL = DefaultBandwidthDownloadURL + "?bytes=" + strconv.FormatInt(o.DownloadBytes, 10)
+	}
+	if o.UploadURL == "" {
+		o.UploadURL = DefaultBandwidthUploadURL
+	}
+	return o
+}
+
+func (o BandwidthOptions) maxDuration(limits BandwidthLimits) time.Duration {
+	if o.MaxDuration <= 0 {
+		return min(defaultBandwidthDuration, limits.MaxDuration)
+	}
+	return min(time.Duration(o.MaxDuration)*time.Second, limits.MaxDuration)
+}
+
+// measureBandwidth downloads and optionally uploads data through the tunnel,
+// each transfer in its own connection, within the limits of the server.
+func measureBandwidth(ctx context.Context, dialer *shadowDialer, options BandwidthOptions, limits BandwidthLimits) *BandwidthResult {
+	switch {
+	case limits.Mode == BandwidthOff:
+		return &BandwidthResult{Download: &TransferResult{Error: "the bandwidth test is disabled on this server"}}
+	case limits.Mode != BandwidthCustomURLs && (options.DownloadURL != "" || options.UploadURL != ""):
+		return &BandwidthResult{Download: &TransferResult{Error: "only the default bandwidth test URLs are allowed on this server"}}
+	}
+
+	options = options.withDefaults(limits)
+	maxDuration := options.maxDuration(limits)
+	result := &BandwidthResult{
+		Download: transfer(ctx, dialer, http.MethodGet, options.DownloadURL, options.DownloadBytes, maxDuration),
+	}
+	if options.UploadBytes > 0 {
+		result.Upload = transfer(ctx, dialer, http.MethodPost, options.UploadURL, options.UploadBytes, maxDuration)
+	}
+	return result
+}
+
+func transfer(ctx context.Context, dialer *shadowDialer, method, target string, size int64, maxDuration time.Duration) *TransferResult {
+	if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return &TransferResult{Error: fmt.Sprintf("invalid bandwidth test URL %q", target)}
+	}
+
+	httpClient, _, closeTunnel, err := dialer.httpClient(ctx, maxDuration, maxDuration, nil)
+	if err != nil {
+		return &TransferResult{Error: err.Error()}
+	}
+	defer closeTunnel()
+
+	// The upload is timed from the end of the headers, leaving out the
+	// connection and the TLS handshake like the download does. The headers
+	// are written by another goroutine than the one reading the response.
+	var firstByte time.Duration
+	var headersWritten atomic.Int64
+	start := time.Now()
+	trace := &httptrace.ClientTrace{
+		WroteHeaders:         func() { headersWritten.Store(int64(time.Since(start))) },
+		GotFirstResponseByte: func() { firstByte = time.Since(start) },
+	}
+	var body io.Reader
+	if method == http.MethodPost {
+		body = io.LimitReader(zeroReader{}, size)
+	}
+	request, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), method, target, body)
+	if err != nil {
+		return &TransferResult{Error: err.Error()}
+	}
+	request.Header.Set("User-Agent", "ShadowTest")
+	if method == http.MethodPost {
+		request.ContentLength = size
+		request.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return &TransferResult{Error: err.Error(), Duration: milliseconds(time.Since(start))}
+	}
+	defer func() {
+		closeErr := response.Body.Close()
+		if closeErr != nil {
+			log.Errorf("failed to close response body: %v", closeErr)
+			sentry.CaptureException(closeErr)
+		}
+	}()
+
+	result := &TransferResult{TTFB: milliseconds(firstByte)}
+	// Redirects are not followed, as the tunnel only carries one connection.
+	if location := response.Header.Get("Location"); location != "" && response.StatusCode >= 300 && response.StatusCode <= 399 {
+		result.Error = fmt.Sprintf("redirected to %s, the final URL must be given", location)
+		result.Duration = milliseconds(time.Since(start))
+		return result
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		result.Error = fmt.Sprintf("unexpected status %s", response.Status)
+		result.Duration = milliseconds(time.Since(start))
+		return result
+	}
+
+	if method == http.MethodPost {
+		uploadDuration := firstByte - time.Duration(headersWritten.Load())
+		result.Bytes = size
+		result.Duration = milliseconds(uploadDuration)
+		result.BytesPerSecond = bytesPerSecond(size, uploadDuration)
+		return result
+	}
+
+	n, err := io.Copy(io.Discard, io.LimitReader(response.Body, size))
+	elapsed := time.Since(start)
+	result.Bytes = n
+	result.Duration = milliseconds(elapsed)
+	result.BytesPerSecond = bytesPerSecond(n, elapsed-firstByte)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func bytesPerSecond(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
@@ -0,0 +1,146 @@
+package ssproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSpeedTestServer serves the number of bytes asked in the bytes parameter
+// and counts the bytes posted to it.
+func newSpeedTestServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			n, _ := io.Copy(io.Discard, r.Body)
+			_, _ = fmt.Fprint(w, n)
+			return
+		}
+		n, err := strconv.ParseInt(r.URL.Query().Get("bytes"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, _ = io.CopyN(w, zeroReader{}, n)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// customBandwidthLimits accepts the URLs of the local speed test servers.
+var customBandwidthLimits = BandwidthLimits{
+	Mode:        BandwidthCustomURLs,
+	MaxBytes:    DefaultBandwidthLimits.MaxBytes,
+	MaxDuration: DefaultBandwidthLimits.MaxDuration,
+}
+
+func newTestDialer(t *testing.T) *shadowDialer {
+	key := startShadowsocksServer(t, "chacha20-ietf-poly1305", "password")
+	dialer, err := newShadowDialer(context.Background(), key)
+	require.NoError(t, err)
+	t.Cleanup(dialer.stop)
+	return dialer
+}
+
+func TestMeasureBandwidth(t *testing.T) {
+	server := newSpeedTestServer(t)
+	dialer := newTestDialer(t)
+
+	result := measureBandwidth(context.Background(), dialer, BandwidthOptions{
+		DownloadURL:   server.URL + "/?bytes=1048576",
+		DownloadBytes: 512 * 1024,
+		UploadURL:     server.URL,
+		UploadBytes:   256 * 1024,
+	}, customBandwidthLimits)
+	require.NotNil(t, result.Download)
+	assert.Empty(t, result.Download.Error)
+	assert.Equal(t, int64(512*1024), result.Download.Bytes)
+	assert.Greater(t, result.Download.BytesPerSecond, 0.0)
+	assert.Greater(t, result.Download.TTFB, 0.0)
+
+	require.NotNil(t, result.Upload)
+	assert.Empty(t, result.Upload.Error)
+	assert.Equal(t, int64(256*1024), result.Upload.Bytes)
+	assert.Greater(t, result.Upload.BytesPerSecond, 0.0)
+}
+
+func TestMeasureBandwidthDownloadOnly(t *testing.T) {
+	server := newSpeedTestServer(t)
+	dialer := newTestDialer(t)
+
+	result := measureBandwidth(context.Background(), dialer, BandwidthOptions{DownloadURL: server.URL + "/?bytes=1000"}, customBandwidthLimits)
+	require.NotNil(t, result.Download)
+	assert.Empty(t, result.Download.Error)
+	assert.Equal(t, int64(1000), result.Download.Bytes)
+	assert.Nil(t, result.Upload)
+}
+
+func TestMeasureBandwidthErrors(t *testing.T) {
+	server := newSpeedTestServer(t)
+	dialer := newTestDialer(t)
+
+	result := measureBandwidth(context.Background(), dialer, BandwidthOptions{DownloadURL: server.URL + "/?bytes=invalid"}, customBandwidthLimits)
+	assert.Equal(t, "unexpected status 400 Bad Request", result.Download.Error)
+
+	result = measureBandwidth(context.Background(), dialer, BandwidthOptions{DownloadURL: "file:///etc/passwd"}, customBandwidthLimits)
+	assert.Equal(t, `invalid bandwidth test URL "file:///etc/passwd"`, result.Download.Error)
+}
+
+func TestMeasureBandwidthRedirect(t *testing.T) {
+	server := httptest.NewServer(http.RedirectHandler("https://cdn.example.com/file", http.StatusFound))
+	defer server.Close()
+	dialer := newTestDialer(t)
+
+	start := time.Now()
+	result := measureBandwidth(context.Background(), dialer, BandwidthOptions{DownloadURL: server.URL, MaxDuration: 5}, customBandwidthLimits)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	require.NotNil(t, result.Download)
+	assert.Equal(t, "redirected to https://cdn.example.com/file, the final URL must be given", result.Download.Error)
+	assert.Zero(t, result.Download.Bytes)
+}
+
+func TestMeasureBandwidthLimits(t *testing.T) {
+	dialer := newTestDialer(t)
+
+	result := measureBandwidth(context.Background(), dialer, BandwidthOptions{}, BandwidthLimits{Mode: BandwidthOff, MaxBytes: 1, MaxDuration: time.Second})
+	assert.Equal(t, "the bandwidth test is disabled on this server", result.Download.Error)
+	assert.Nil(t, result.Upload)
+
+	result = measureBandwidth(context.Background(), dialer, BandwidthOptions{UploadURL: "http://192.0.2.1/", UploadBytes: 1}, DefaultBandwidthLimits)
+	assert.Equal(t, "only the default bandwidth test URLs are allowed on this server", result.Download.Error)
+	assert.Nil(t, result.Upload)
+}
+
+func TestSetBandwidthLimits(t *testing.T) {
+	t.Cleanup(func() { require.NoError(t, SetBandwidthLimits(DefaultBandwidthLimits)) })
+
+	assert.Error(t, SetBandwidthLimits(BandwidthLimits{Mode: "all", MaxBytes: 1, MaxDuration: time.Second}))
+	assert.Error(t, SetBandwidthLimits(BandwidthLimits{Mode: BandwidthOff}))
+	assert.Equal(t, DefaultBandwidthLimits, getBandwidthLimits())
+
+	limits := BandwidthLimits{Mode: BandwidthCustomURLs, MaxBytes: 1024, MaxDuration: time.Second}
+	require.NoError(t, SetBandwidthLimits(limits))
+	assert.Equal(t, limits, getBandwidthLimits())
+}
+
+func TestBandwidthOptionsDefaults(t *testing.T) {
+	limits := DefaultBandwidthLimits
+	options := BandwidthOptions{UploadBytes: -1, MaxDuration: 3600}.withDefaults(limits)
+	assert.Equal(t, int64(defaultBandwidthBytes), options.DownloadBytes)
+	assert.Equal(t, DefaultBandwidthDownloadURL+"?bytes=2097152", options.DownloadURL)
+	assert.Equal(t, int64(0), options.UploadBytes)
+	assert.Equal(t, limits.MaxDuration, options.maxDuration(limits))
+	assert.Equal(t, defaultBandwidthDuration, BandwidthOptions{}.maxDuration(limits))
+	assert.Equal(t, 5*time.Second, BandwidthOptions{MaxDuration: 5}.maxDuration(limits))
+	assert.Equal(t, time.Second, BandwidthOptions{}.maxDuration(BandwidthLimits{MaxDuration: time.Second}))
+
+	options = BandwidthOptions{DownloadBytes: 1 << 40}.withDefaults(limits)
+	assert.Equal(t, limits.MaxBytes, options.DownloadBytes)
+}
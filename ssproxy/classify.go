@@ -0,0 +1,258 @@
+package ssproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// IPCategory is the kind of addresses an IP list holds.
+type IPCategory string
+
+const (
+	IPCategoryTor        IPCategory = "tor"
+	IPCategoryDatacenter IPCategory = "datacenter"
+	IPCategoryVPN        IPCategory = "vpn"
+	IPCategoryBlocklist  IPCategory = "blocklist"
+)
+
+const (
+	ipListFetchTimeout = 30 * time.Second
+	ipListMaxSize      = 64 * 1024 * 1024
+)
+
+// IPListSource is a list of addresses and ranges loaded from a file or an
+// http(s) URL. The list has one address or CIDR range per line, where the first
+// field that parses is used, so Tor exit lists and the pretty-printed JSON
+// ranges of cloud providers can be used as they are.
+type IPListSource struct {
+	Name     string     `json:"name"`
+	Category IPCategory `json:"category"`
+	Source   string     `json:"source"`
+}
+
+// IPClassification lists the categories and the lists an IP was found in.
+type IPClassification struct {
+	Categories []IPCategory `json:"categories"`
+	Lists      []IPListHit  `json:"lists"`
+}
+
+// IPListHit is a list an IP was found in.
+type IPListHit struct {
+	Name     string     `json:"name"`
+	Category IPCategory `json:"category"`
+}
+
+// IPClassifier classifies IPs against lists refreshed from their sources.
+type IPClassifier struct {
+	sources []IPListSource
+
+	mu    sync.RWMutex
+	lists map[string][]netip.Prefix
+}
+
+var (
+	ipClassifierMu sync.Mutex
+	ipClassifier   *IPClassifier
+)
+
+// NewIPClassifier returns a classifier of the sources. Lists are empty until
+// they are refreshed.
+func NewIPClassifier(sources []IPListSource) (*IPClassifier, error) {
+	names := map[string]bool{}
+	for _, source := range sources {
+		switch source.Category {
+		case IPCategoryTor, IPCategoryDatacenter, IPCategoryVPN, IPCategoryBlocklist:
+		default:
+			return nil, fmt.Errorf("unknown category %q for IP list %q", source.Category, source.Name)
+		}
+		if source.Name == "" || source.Source == "" {
+			return nil, errors.New("IP lists need a name and a source")
+		}
+		if names[source.Name] {
+			return nil, fmt.Errorf("duplicated IP list %q", source.Name)
+		}
+		names[source.Name] = true
+	}
+	return &IPClassifier{sources: sources, lists: map[string][]netip.Prefix{}}, nil
+}
+
+// SetIPClassifier classifies the exit IP of every test with c. Passing nil
+// stops the classification.
+func SetIPClassifier(c *IPClassifier) {
+	ipClassifierMu.Lock()
+	defer ipClassifierMu.Unlock()
+	ipClassifier = c
+}
+
+func getIPClassifier() *IPClassifier {
+	ipClassifierMu.Lock()
+	defer ipClassifierMu.Unlock()
+	return ipClassifier
+}
+
+// Refresh reloads every list from its source. Lists that cannot be loaded keep
+// their previous version, and their errors are returned together.
+func (c *IPClassifier) Refresh(ctx context.Context) error {
+	var errs []error
+	for _, source := range c.sources {
+		prefixes, err := loadIPList(ctx, source.Source)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to load IP list %s: %w", source.Name, err))
+			continue
+		}
+		c.mu.Lock()
+		c.lists[source.Name] = prefixes
+		c.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// Run refreshes the lists right away and then every interval until the
+// context is done.
+func (c *IPClassifier) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := c.Refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Errorf("failed to refresh the IP lists: %v", err)
+			sentry.CaptureException(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Classify returns the lists containing ip, in the order of the sources.
+func (c *IPClassifier) Classify(ip netip.Addr) IPClassification {
+	ip = ip.Unmap()
+	result := IPClassification{Categories: []IPCategory{}, Lists: []IPListHit{}}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, source := range c.sources {
+		for _, prefix := range c.lists[source.Name] {
+			if prefix.Contains(ip) {
+				result.Lists = append(result.Lists, IPListHit{Name: source.Name, Category: source.Category})
+				if !slices.Contains(result.Categories, source.Category) {
+					result.Categories = append(result.Categories, source.Category)
+				}
+				break
+			}
+		}
+	}
+	return result
+}
+
+// classifyIPInfo classifies the IP of info when there is a classifier, also
+// flagging Tor exits.
+func classifyIPInfo(info *IPInfo) *IPClassification {
+	c := getIPClassifier()
+	if c == nil {
+		return nil
+	}
+	ip, err := netip.ParseAddr(info.IPAddress)
+	if err != nil {
+		return nil
+	}
+	result := c.Classify(ip)
+	if slices.Contains(result.Categories, IPCategoryTor) {
+		info.TorExit = true
+	}
+	return &result
+}
+
+// loadIPList reads the list at source, a path or an http(s) URL.
+func loadIPList(ctx context.Context, source string) ([]netip.Prefix, error) {
+	var body []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		body, err = fetchIPList(ctx, source)
+	} else {
+		body, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseIPList(body)
+}
+
+func fetchIPList(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, ipListFetchTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", "ShadowTest")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		closeErr := response.Body.Close()
+		if closeErr != nil {
+			log.Errorf("failed to close response body: %v", closeErr)
+			sentry.CaptureException(closeErr)
+		}
+	}()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, ipListMaxSize))
+}
+
+// parseIPList reads the first address or range of every line, ignoring
+// comments and lines without any.
+func parseIPList(body []byte) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, ipListMaxSize)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == ',' || r == ';'
+		})
+		for _, field := range fields {
+			if prefix, ok := parseIPListEntry(strings.Trim(field, `"'[]`)); ok {
+				prefixes = append(prefixes, prefix)
+				break
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return prefixes, nil
+}
+
+func parseIPListEntry(field string) (netip.Prefix, bool) {
+	if strings.Contains(field, "/") {
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return netip.Prefix{}, false
+		}
+		return prefix.Masked(), true
+	}
+	ip, err := netip.ParseAddr(field)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	ip = ip.Unmap()
+	return netip.PrefixFrom(ip, ip.BitLen()), true
+}
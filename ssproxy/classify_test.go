@@ -0,0 +1,122 @@
+package ssproxy
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIPList(t *testing.T) {
+	prefixes, err := parseIPList([]byte(`# Tor exit list
+ExitNode 0011BD2485AD45D984EC4159C88FC066E5E3300E
+ExitAddress 192.0.2.1 2024-01-01 00:00:00
+198.51.100.0/24 # comment
+203.0.113.7/24
+2001:db8::1
+::ffff:192.0.2.9
+      "ip_prefix": "3.5.140.0/22",
+      "13.66.60.119/32",
+      "syncToken": "1700000000",
+not an address
+`))
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("192.0.2.1/32"),
+		netip.MustParsePrefix("198.51.100.0/24"),
+		netip.MustParsePrefix("203.0.113.0/24"),
+		netip.MustParsePrefix("2001:db8::1/128"),
+		netip.MustParsePrefix("192.0.2.9/32"),
+		netip.MustParsePrefix("3.5.140.0/22"),
+		netip.MustParsePrefix("13.66.60.119/32"),
+	}, prefixes)
+}
+
+func TestNewIPClassifierErrors(t *testing.T) {
+	_, err := NewIPClassifier([]IPListSource{{Name: "list", Category: "unknown", Source: "list.txt"}})
+	assert.EqualError(t, err, `unknown category "unknown" for IP list "list"`)
+	_, err = NewIPClassifier([]IPListSource{{Name: "list", Category: IPCategoryVPN}})
+	assert.Error(t, err)
+	_, err = NewIPClassifier([]IPListSource{
+		{Name: "list", Category: IPCategoryVPN, Source: "a.txt"},
+		{Name: "list", Category: IPCategoryTor, Source: "b.txt"},
+	})
+	assert.EqualError(t, err, `duplicated IP list "list"`)
+}
+
+func TestIPClassifier(t *testing.T) {
+	dir := t.TempDir()
+	torPath := filepath.Join(dir, "tor.txt")
+	require.NoError(t, os.WriteFile(torPath, []byte("ExitAddress 192.0.2.1 2024-01-01 00:00:00\n"), 0o644))
+	blocklistPath := filepath.Join(dir, "blocklist.txt")
+	require.NoError(t, os.WriteFile(blocklistPath, []byte("192.0.2.0/24\n"), 0o644))
+	datacenter := newIPInfoServer(t, http.StatusOK, "198.51.100.0/24\n192.0.2.0/28\n")
+	broken := newIPInfoServer(t, http.StatusNotFound, "")
+
+	classifier, err := NewIPClassifier([]IPListSource{
+		{Name: "tor-exits", Category: IPCategoryTor, Source: torPath},
+		{Name: "hosting", Category: IPCategoryDatacenter, Source: datacenter.URL},
+		{Name: "missing", Category: IPCategoryVPN, Source: filepath.Join(dir, "missing.txt")},
+		{Name: "broken", Category: IPCategoryVPN, Source: broken.URL},
+		{Name: "local", Category: IPCategoryBlocklist, Source: blocklistPath},
+	})
+	require.NoError(t, err)
+	err = classifier.Refresh(context.Background())
+	assert.ErrorContains(t, err, "unable to load IP list missing")
+	assert.ErrorContains(t, err, "unable to load IP list broken: unexpected status 404")
+
+	assert.Equal(t, IPClassification{
+		Categories: []IPCategory{IPCategoryTor, IPCategoryDatacenter, IPCategoryBlocklist},
+		Lists: []IPListHit{
+			{Name: "tor-exits", Category: IPCategoryTor},
+			{Name: "hosting", Category: IPCategoryDatacenter},
+			{Name: "local", Category: IPCategoryBlocklist},
+		},
+	}, classifier.Classify(netip.MustParseAddr("192.0.2.1")))
+	assert.Equal(t, []IPCategory{IPCategoryDatacenter}, classifier.Classify(netip.MustParseAddr("198.51.100.5")).Categories)
+	assert.Empty(t, classifier.Classify(netip.MustParseAddr("203.0.113.1")).Lists)
+
+	// A list that cannot be refreshed keeps its previous version.
+	require.NoError(t, os.Remove(torPath))
+	assert.Error(t, classifier.Refresh(context.Background()))
+	assert.Contains(t, classifier.Classify(netip.MustParseAddr("192.0.2.1")).Categories, IPCategoryTor)
+
+	SetIPClassifier(classifier)
+	t.Cleanup(func() { SetIPClassifier(nil) })
+	info := IPInfo{IPAddress: "192.0.2.1"}
+	classification := classifyIPInfo(&info)
+	require.NotNil(t, classification)
+	assert.True(t, info.TorExit)
+}
+
+func TestIPClassifierRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.txt")
+	require.NoError(t, os.WriteFile(path, []byte("192.0.2.0/24\n"), 0o644))
+	classifier, err := NewIPClassifier([]IPListSource{{Name: "list", Category: IPCategoryVPN, Source: path}})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		classifier.Run(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	assert.Eventually(t, func() bool {
+		return len(classifier.Classify(netip.MustParseAddr("192.0.2.1")).Lists) == 1
+	}, time.Second, 5*time.Millisecond)
+	require.NoError(t, os.WriteFile(path, []byte("198.51.100.0/24\n"), 0o644))
+	assert.Eventually(t, func() bool {
+		return len(classifier.Classify(netip.MustParseAddr("198.51.100.1")).Lists) == 1
+	}, time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,94 @@
+package ssproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// ShadowTestProvider queries the IP echo endpoint of another ShadowTest
+// instance, which answers in the IPInfo format.
+type ShadowTestProvider struct {
+	BaseURL string
+}
+
+// NewShadowTestProvider returns the provider of the ShadowTest instance at
+// baseURL, like "http://shadowtest.example.com:8080".
+func NewShadowTestProvider(baseURL string) *ShadowTestProvider {
+	return &ShadowTestProvider{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+func (p *ShadowTestProvider) Name() string      { return "shadowtest" }
+func (p *ShadowTestProvider) HealthURL() string { return p.BaseURL + "/health" }
+
+// URL returns the same endpoint for every family, asking it to reject callers
+// of another family.
+func (p *ShadowTestProvider) URL(family Family) string {
+	if family == FamilyIPv4 || family == FamilyIPv6 {
+		return p.BaseURL + "/v3/ip?family=" + string(family)
+	}
+	return p.BaseURL + "/v3/ip"
+}
+
+func (p *ShadowTestProvider) Decode(body []byte) (IPInfo, error) {
+	return decodeIPInfo(body)
+}
+
+// IPEchoHandler answers with the IPInfo of the caller, enriched from the GeoIP
+// database when there is one. The family query parameter rejects callers of
+// another address family. The caller is read from the last X-Forwarded-For
+// address when trustForwardedFor is set, for instances behind a reverse proxy.
+func IPEchoHandler(trustForwardedFor bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method is not supported.", http.StatusMethodNotAllowed)
+			return
+		}
+		family := Family(r.URL.Query().Get("family"))
+		if err := family.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ip, err := callerIP(r, trustForwardedFor)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if (family == FamilyIPv4 && !ip.Is4()) || (family == FamilyIPv6 && !ip.Is6()) {
+			http.Error(w, fmt.Sprintf("%s is not an %s address", ip, family), http.StatusBadRequest)
+			return
+		}
+
+		info := IPInfo{IPAddress: ip.String()}
+		enrichIPInfo(&info)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			log.Errorf("error occurred when sending the data back to the client %v", err)
+			sentry.CaptureException(err)
+		}
+	})
+}
+
+// callerIP returns the IP of the client of r.
+func callerIP(r *http.Request, trustForwardedFor bool) (netip.Addr, error) {
+	address := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	if forwarded := r.Header.Values("X-Forwarded-For"); trustForwardedFor && len(forwarded) > 0 {
+		hops := strings.Split(forwarded[len(forwarded)-1], ",")
+		address = strings.TrimSpace(hops[len(hops)-1])
+	}
+	ip, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid client address %q", address)
+	}
+	return ip.Unmap(), nil
+}
@@ -0,0 +1,97 @@
+package ssproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echoRequest(t *testing.T, handler http.Handler, target, remoteAddr, forwardedFor string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestIPEchoHandler(t *testing.T) {
+	handler := IPEchoHandler(false)
+
+	rr := echoRequest(t, handler, "/v3/ip", "192.0.2.1:4321", "198.51.100.1")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var info IPInfo
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&info))
+	assert.Equal(t, IPInfo{IPAddress: "192.0.2.1"}, info)
+
+	rr = echoRequest(t, handler, "/v3/ip?family=ipv4", "[::ffff:192.0.2.1]:4321", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = echoRequest(t, handler, "/v3/ip?family=ipv6", "192.0.2.1:4321", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "192.0.2.1 is not an ipv6 address\n", rr.Body.String())
+
+	rr = echoRequest(t, handler, "/v3/ip?family=ipv5", "192.0.2.1:4321", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestIPEchoHandlerForwardedFor(t *testing.T) {
+	handler := IPEchoHandler(true)
+
+	rr := echoRequest(t, handler, "/v3/ip", "10.0.0.1:4321", "203.0.113.9, 2001:db8::1")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var info IPInfo
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&info))
+	assert.Equal(t, "2001:db8::1", info.IPAddress)
+
+	rr = echoRequest(t, handler, "/v3/ip", "10.0.0.1:4321", "unknown")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestIPEchoHandlerEnriched(t *testing.T) {
+	cityPath, asnPath := writeTestGeoIPDatabases(t, "Berlin")
+	db, err := OpenGeoIPDatabase(cityPath, asnPath)
+	require.NoError(t, err)
+	SetGeoIPDatabase(db)
+	t.Cleanup(func() { SetGeoIPDatabase(nil) })
+
+	rr := echoRequest(t, IPEchoHandler(false), "/v3/ip", "192.0.2.1:4321", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var info IPInfo
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&info))
+	assert.Equal(t, "DE", info.CountryCode)
+	assert.Equal(t, uint(64500), info.ASN)
+}
+
+func TestShadowTestProviderURL(t *testing.T) {
+	provider := NewShadowTestProvider("http://shadowtest.example.com/")
+	assert.Equal(t, "http://shadowtest.example.com/v3/ip", provider.URL(FamilyAny))
+	assert.Equal(t, "http://shadowtest.example.com/v3/ip?family=ipv4", provider.URL(FamilyIPv4))
+	assert.Equal(t, "http://shadowtest.example.com/health", provider.HealthURL())
+}
+
+func TestGetShadowsocksKeyDetailsThroughShadowTest(t *testing.T) {
+	server := httptest.NewServer(IPEchoHandler(false))
+	defer server.Close()
+	useIPInfoProviders(t, NewShadowTestProvider(server.URL))
+	key := startShadowsocksServer(t, "chacha20-ietf-poly1305", "password")
+
+	details, err := GetShadowsocksKeyDetails(key, 5, Options{Family: FamilyIPv4})
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", details.IPAddress)
+	assert.Equal(t, "shadowtest", details.Provider)
+	assert.Equal(t, key.Port, details.Key.Port)
+	require.NotNil(t, details.Entry)
+	assert.Equal(t, "127.0.0.1", details.Entry.IPAddress)
+	require.NotNil(t, details.IsRelay)
+	assert.False(t, *details.IsRelay)
+
+	_, err = GetShadowsocksKeyDetails(key, 5, Options{Family: FamilyIPv6})
+	assertStageError(t, err, StageUpstream, CodeUpstreamStatus)
+}
@@ -0,0 +1,159 @@
+package ssproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// IPAPIEntryLookupURL looks up entry IPs on ip-api.com, which is only
+// reachable over plain HTTP and allows 45 requests per minute.
+const IPAPIEntryLookupURL = "http://ip-api.com/json/{ip}?fields=status,message,country,countryCode,city,isp,as,query"
+
+const (
+	entryLookupTimeout = 5 * time.Second
+	entryLookupMaxSize = 64 * 1024
+	// entryLookupPlaceholder is replaced by the IP in entry lookup URLs.
+	entryLookupPlaceholder = "{ip}"
+)
+
+var (
+	entryLookupURLMu sync.Mutex
+	entryLookupURL   string
+)
+
+// EntryInfo describes the server IP the tests connected to, next to the exit
+// information reported through the tunnel. Only the IP is set when there is
+// neither a GeoIP database nor an entry lookup URL, as the IP-info providers
+// can only describe the IP of their caller.
+type EntryInfo struct {
+	IPInfo
+	Error string `json:"error,omitempty"`
+}
+
+// SetEntryLookupURL looks up the entry IPs at lookupURL, queried directly and
+// never through the tunnel, when there is no GeoIP database. The {ip} of the
+// URL is replaced by the IP and the answer must be in the ip-api.com format, like
+// with IPAPIEntryLookupURL. Without a URL, the default, entry IPs are only
+// described from the GeoIP database.
+func SetEntryLookupURL(lookupURL string) error {
+	if lookupURL != "" && !strings.Contains(lookupURL, entryLookupPlaceholder) {
+		return fmt.Errorf("the entry lookup URL %q must have %s in place of the IP", lookupURL, entryLookupPlaceholder)
+	}
+	entryLookupURLMu.Lock()
+	defer entryLookupURLMu.Unlock()
+	entryLookupURL = lookupURL
+	return nil
+}
+
+func getEntryLookupURL() string {
+	entryLookupURLMu.Lock()
+	defer entryLookupURLMu.Unlock()
+	return entryLookupURL
+}
+
+// getEntryInfo describes the IP the dialer connected to, waiting for the first
+// connection, from the GeoIP database when there is one or else from lookupURL
+// when it is set. Errors looking up the IP are reported in the result along
+// with the IP.
+func getEntryInfo(ctx context.Context, dialer *shadowDialer, lookupURL string, timeout time.Duration) *EntryInfo {
+	ip, err := dialer.entryIP(ctx)
+	if err != nil {
+		return &EntryInfo{Error: err.Error()}
+	}
+	entry := &EntryInfo{IPInfo: IPInfo{IPAddress: ip.String()}}
+	if !isPublicIP(ip) {
+		entry.Error = "the server address is not public"
+		return entry
+	}
+	if db := getGeoIPDatabase(); db != nil {
+		if err := db.Enrich(&entry.IPInfo); err != nil {
+			entry.Error = err.Error()
+		}
+		return entry
+	}
+	if lookupURL == "" {
+		return entry
+	}
+
+	info, err := lookupIP(ctx, lookupURL, ip, min(timeout, entryLookupTimeout))
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+	entry.IPInfo = info
+	return entry
+}
+
+// lookupIP gets the location and network of ip from an ip-api.com compatible
+// service.
+func lookupIP(ctx context.Context, lookupURL string, ip netip.Addr, timeout time.Duration) (IPInfo, error) {
+	transport := &http.Transport{
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Timeout: timeout, Transport: transport}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(lookupURL, entryLookupPlaceholder, ip.String()), nil)
+	if err != nil {
+		return IPInfo{}, err
+	}
+	request.Header.Set("User-Agent", "ShadowTest")
+	response, err := client.Do(request)
+	if err != nil {
+		return IPInfo{}, fmt.Errorf("unable to look up %s: %w", ip, err)
+	}
+	defer func() {
+		closeErr := response.Body.Close()
+		if closeErr != nil {
+			log.Errorf("failed to close response body: %v", closeErr)
+			sentry.CaptureException(closeErr)
+		}
+	}()
+	if response.StatusCode != http.StatusOK {
+		return IPInfo{}, fmt.Errorf("unable to look up %s: unexpected status %s", ip, response.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, entryLookupMaxSize))
+	if err != nil {
+		return IPInfo{}, fmt.Errorf("unable to look up %s: %w", ip, err)
+	}
+	info, err := decodeIPAPI(body)
+	if err != nil {
+		return IPInfo{}, fmt.Errorf("unable to look up %s: %w", ip, err)
+	}
+	info.IPAddress = ip.String()
+	info.Provider = "ip-api"
+	return info, nil
+}
+
+// isRelay reports whether the exit IP differs from the entry IP. It returns
+// nil when that cannot be told: the entry is unknown or the IPs belong to
+// different families, as dual-stack servers have one exit per family.
+func isRelay(entry *EntryInfo, exit IPInfo) *bool {
+	if entry == nil {
+		return nil
+	}
+	entryIP, err := netip.ParseAddr(entry.IPAddress)
+	if err != nil {
+		return nil
+	}
+	exitIP, err := netip.ParseAddr(exit.IPAddress)
+	if err != nil {
+		return nil
+	}
+	entryIP, exitIP = entryIP.Unmap(), exitIP.Unmap()
+	if entryIP.Is4() != exitIP.Is4() {
+		return nil
+	}
+	relay := entryIP != exitIP
+	return &relay
+}
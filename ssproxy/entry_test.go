@@ -0,0 +1,104 @@
+package ssproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntryIPRecordsConnectedServer(t *testing.T) {
+	server := newSpeedTestServer(t)
+	dialer := newTestDialer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := dialer.entryIP(ctx)
+	assert.EqualError(t, err, "the server was never connected")
+
+	entryIP := make(chan netip.Addr, 1)
+	go func() {
+		ip, _ := dialer.entryIP(context.Background())
+		entryIP <- ip
+	}()
+	result := measureBandwidth(context.Background(), dialer, BandwidthOptions{DownloadURL: server.URL + "/?bytes=10"}, customBandwidthLimits)
+	require.Empty(t, result.Download.Error)
+	assert.Equal(t, netip.MustParseAddr("127.0.0.1"), <-entryIP)
+
+	ip, err := dialer.entryIP(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddr("127.0.0.1"), ip)
+
+	entry := getEntryInfo(context.Background(), dialer, "http://invalid.invalid/{ip}", time.Second)
+	assert.Equal(t, "127.0.0.1", entry.IPAddress)
+	assert.Equal(t, "the server address is not public", entry.Error)
+}
+
+func TestLookupIP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json/203.0.113.7":
+			_, _ = fmt.Fprint(w, `{"status":"success","country":"Germany","countryCode":"DE","city":"Berlin","isp":"Example","as":"AS64500 Example GmbH","query":"203.0.113.7"}`)
+		case "/json/203.0.113.8":
+			_, _ = fmt.Fprint(w, `{"status":"fail","message":"reserved range","query":"203.0.113.8"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	lookupURL := server.URL + "/json/{ip}"
+
+	info, err := lookupIP(context.Background(), lookupURL, netip.MustParseAddr("203.0.113.7"), time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, IPInfo{
+		IPAddress:      "203.0.113.7",
+		Location:       "Berlin, Germany",
+		ISP:            "Example",
+		CountryCode:    "DE",
+		City:           "Berlin",
+		Country:        "Germany",
+		ASN:            64500,
+		ASOrganization: "Example GmbH",
+		Provider:       "ip-api",
+	}, info)
+
+	_, err = lookupIP(context.Background(), lookupURL, netip.MustParseAddr("203.0.113.8"), time.Second)
+	assert.ErrorContains(t, err, "reserved range")
+
+	_, err = lookupIP(context.Background(), lookupURL, netip.MustParseAddr("203.0.113.9"), time.Second)
+	assert.ErrorContains(t, err, "unexpected status 404")
+}
+
+func TestSetEntryLookupURL(t *testing.T) {
+	t.Cleanup(func() { _ = SetEntryLookupURL("") })
+
+	assert.Empty(t, getEntryLookupURL())
+	require.NoError(t, SetEntryLookupURL(IPAPIEntryLookupURL))
+	assert.Equal(t, IPAPIEntryLookupURL, getEntryLookupURL())
+	assert.Error(t, SetEntryLookupURL("http://ip.example.com/json"))
+	assert.Equal(t, IPAPIEntryLookupURL, getEntryLookupURL())
+	require.NoError(t, SetEntryLookupURL(""))
+	assert.Empty(t, getEntryLookupURL())
+}
+
+func TestIsRelay(t *testing.T) {
+	entry := &EntryInfo{IPInfo: IPInfo{IPAddress: "203.0.113.7"}}
+
+	assert.Nil(t, isRelay(nil, IPInfo{IPAddress: "203.0.113.7"}))
+	assert.Nil(t, isRelay(&EntryInfo{Error: "the server was never connected"}, IPInfo{IPAddress: "203.0.113.7"}))
+	assert.Nil(t, isRelay(entry, IPInfo{IPAddress: "2001:db8::1"}))
+
+	relay := isRelay(entry, IPInfo{IPAddress: "203.0.113.7"})
+	require.NotNil(t, relay)
+	assert.False(t, *relay)
+
+	relay = isRelay(entry, IPInfo{IPAddress: "198.51.100.1"})
+	require.NotNil(t, relay)
+	assert.True(t, *relay)
+}
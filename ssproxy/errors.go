@@ -0,0 +1,96 @@
+package ssproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+)
+
+// Stage is the step of a test in which it failed.
+type Stage string
+
+// Stages of a test, in the order they happen.
+const (
+	StageParse     Stage = "parse"
+	StageResolve   Stage = "resolve"
+	StageConnect   Stage = "connect"
+	StageHandshake Stage = "handshake"
+	StageUpstream  Stage = "upstream"
+	StageDecode    Stage = "decode"
+)
+
+// Failure codes of a StageError. They are part of the API and must not change.
+const (
+	CodeInvalidKey        = "invalid_key"
+	CodeUnknownCipher     = "unknown_cipher"
+	CodeInvalidOptions    = "invalid_options"
+	CodeDynamicKeyFailed  = "dynamic_key_failed"
+	CodeDNSFailed         = "dns_failed"
+	CodePluginFailed      = "plugin_failed"
+	CodeConnectionRefused = "connection_refused"
+	CodeConnectTimeout    = "connect_timeout"
+	CodeConnectFailed     = "connect_failed"
+	CodeAuthFailed        = "auth_failed"
+	CodeHandshakeTimeout  = "handshake_timeout"
+	CodeUpstreamFailed    = "upstream_failed"
+	CodeUpstreamTimeout   = "upstream_timeout"
+	CodeUpstreamStatus    = "upstream_status"
+	CodeDecodeFailed      = "decode_failed"
+)
+
+// StageError is returned when testing a key fails. It names the stage that
+// failed with a stable code and wraps the underlying error.
+type StageError struct {
+	Stage Stage
+	Code  string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("%s failed (%s): %v", e.Stage, e.Code, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+func newStageError(stage Stage, code string, err error) error {
+	return &StageError{Stage: stage, Code: code, Err: err}
+}
+
+// withStage wraps err in a StageError unless it already carries one.
+func withStage(stage Stage, code string, err error) error {
+	var stageErr *StageError
+	if errors.As(err, &stageErr) {
+		return err
+	}
+	return newStageError(stage, code, err)
+}
+
+// cipherError classifies the errors returned when picking the cipher of a key.
+func cipherError(err error) error {
+	if errors.Is(err, core.ErrCipherNotSupported) {
+		return newStageError(StageParse, CodeUnknownCipher, err)
+	}
+	return withStage(StageParse, CodeInvalidKey, err)
+}
+
+// dialError classifies the errors returned when dialing the server.
+func dialError(err error) error {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return newStageError(StageResolve, CodeDNSFailed, err)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return newStageError(StageConnect, CodeConnectionRefused, err)
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return newStageError(StageConnect, CodeConnectTimeout, err)
+	default:
+		return newStageError(StageConnect, CodeConnectFailed, err)
+	}
+}
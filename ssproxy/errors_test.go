@@ -0,0 +1,113 @@
+package ssproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func assertStageError(t *testing.T, err error, stage Stage, code string) {
+	t.Helper()
+	var stageErr *StageError
+	require.True(t, errors.As(err, &stageErr), "%v is not a StageError", err)
+	assert.Equal(t, stage, stageErr.Stage)
+	assert.Equal(t, code, stageErr.Code)
+}
+
+// startSilentServer hands the connections to serve and returns a key pointing
+// at it.
+func startSilentServer(t *testing.T, serve func(net.Conn)) Key {
+	return Key{
+		Host:     "127.0.0.1",
+		Port:     tcpPort(t, startTCPServer(t, serve)),
+		Cipher:   "chacha20-ietf-poly1305",
+		Password: "password",
+	}
+}
+
+func TestStageErrorParse(t *testing.T) {
+	_, err := GetShadowsocksProxyDetails("ss://invalid", true, 1)
+	assertStageError(t, err, StageParse, CodeInvalidKey)
+
+	key := Key{Host: "127.0.0.1", Port: 8388, Cipher: "rot13", Password: "password"}
+	_, err = GetShadowsocksKeyDetails(key, 1, Options{Family: FamilyIPv4})
+	assertStageError(t, err, StageParse, CodeUnknownCipher)
+}
+
+func TestStageErrorConnectionRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	key := Key{Host: "127.0.0.1", Port: port, Cipher: "chacha20-ietf-poly1305", Password: "password"}
+	_, err = GetShadowsocksKeyDetails(key, 5, Options{Family: FamilyIPv4})
+	assertStageError(t, err, StageConnect, CodeConnectionRefused)
+}
+
+func TestStageErrorDNS(t *testing.T) {
+	key := Key{Host: "shadowtest.invalid", Port: 8388, Cipher: "chacha20-ietf-poly1305", Password: "password"}
+	_, err := GetShadowsocksKeyDetails(key, 5, Options{Family: FamilyIPv4})
+	assertStageError(t, err, StageResolve, CodeDNSFailed)
+}
+
+func TestStageErrorServerClosesConnection(t *testing.T) {
+	key := startSilentServer(t, func(c net.Conn) {
+		buf := make([]byte, 64)
+		_, _ = c.Read(buf)
+		_ = c.Close()
+	})
+	_, err := GetShadowsocksKeyDetails(key, 5, Options{Family: FamilyIPv4})
+	assertStageError(t, err, StageHandshake, CodeAuthFailed)
+}
+
+func TestStageErrorServerNeverAnswers(t *testing.T) {
+	done := make(chan struct{})
+	key := startSilentServer(t, func(c net.Conn) {
+		<-done
+		_ = c.Close()
+	})
+	defer close(done)
+	_, err := GetShadowsocksKeyDetails(key, 1, Options{Family: FamilyIPv4})
+	assertStageError(t, err, StageHandshake, CodeHandshakeTimeout)
+	var netErr net.Error
+	assert.True(t, errors.As(err, &netErr) && netErr.Timeout())
+}
+
+func TestTunnelStateRequestError(t *testing.T) {
+	requestErr := errors.New("EOF")
+	timeoutErr := context.DeadlineExceeded
+
+	assertStageError(t, (&tunnelState{}).requestError(timeoutErr), StageConnect, CodeConnectTimeout)
+	assertStageError(t, (&tunnelState{dialed: true, dialErr: os.ErrDeadlineExceeded}).requestError(requestErr), StageConnect, CodeConnectTimeout)
+	assertStageError(t, (&tunnelState{dialed: true, serverErr: errors.New("cipher: message authentication failed")}).requestError(requestErr), StageHandshake, CodeAuthFailed)
+	assertStageError(t, (&tunnelState{dialed: true, serverBytes: 10}).requestError(timeoutErr), StageUpstream, CodeUpstreamTimeout)
+	assertStageError(t, (&tunnelState{dialed: true, serverBytes: 10}).requestError(requestErr), StageUpstream, CodeUpstreamFailed)
+}
+
+func TestTrackedConn(t *testing.T) {
+	client, server := net.Pipe()
+	state := &tunnelState{}
+	tracked := state.wrap(client)
+	go func() {
+		_, _ = server.Write([]byte("hello"))
+		_ = server.Close()
+	}()
+
+	buf := make([]byte, 16)
+	_ = tracked.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := tracked.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	_, err = tracked.Read(buf)
+	assert.Error(t, err)
+	assert.Equal(t, int64(5), state.serverBytes)
+	assert.NoError(t, state.serverErr)
+	_ = tracked.Close()
+}
@@ -0,0 +1,184 @@
+package ssproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	externalPluginStartTimeout = 5 * time.Second
+	externalPluginWaitDelay    = 2 * time.Second
+)
+
+var (
+	externalPluginDirMu sync.RWMutex
+	externalPluginDir   string
+)
+
+// EnableExternalPlugins allows keys using plugins without a native
+// implementation to be tested by spawning the SIP003 plugin binary of the same
+// name found in dir. Only binaries directly inside dir can be executed.
+// Passing an empty dir disables external plugins again.
+func EnableExternalPlugins(dir string) error {
+	if dir != "" {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		absDir, err = filepath.EvalSymlinks(absDir)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(absDir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("plugin directory %s is not a directory", dir)
+		}
+		dir = absDir
+	}
+
+	externalPluginDirMu.Lock()
+	defer externalPluginDirMu.Unlock()
+	externalPluginDir = dir
+	return nil
+}
+
+func getExternalPluginDir() string {
+	externalPluginDirMu.RLock()
+	defer externalPluginDirMu.RUnlock()
+	return externalPluginDir
+}
+
+// externalPluginPath returns the path of the plugin binary inside the
+// allowlisted directory, refusing anything that would resolve outside of it.
+func externalPluginPath(dir, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid plugin name %q", name)
+	}
+
+	path, err := filepath.EvalSymlinks(filepath.Join(dir, name))
+	if err != nil {
+		return "", fmt.Errorf("plugin %s is not available: %w", name, err)
+	}
+	if filepath.Dir(path) != dir {
+		return "", fmt.Errorf("plugin %s resolves outside of the plugin directory", name)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() || !isExecutable(info) {
+		return "", fmt.Errorf("plugin %s is not an executable file", name)
+	}
+	return path, nil
+}
+
+// startExternalPlugin spawns the SIP003 plugin for the key and waits until it
+// listens on its local port. It returns the local address to use instead of
+// the server address and a function that stops the plugin, which must always
+// be called.
+func startExternalPlugin(ctx context.Context, key Key, plugin pluginConfig) (string, func(), error) {
+	dir := getExternalPluginDir()
+	if dir == "" {
+		return "", nil, fmt.Errorf("%w %s", errUnsupportedPlugin, plugin.Name)
+	}
+	path, err := externalPluginPath(dir, plugin.Name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	localPort, err := freeLocalPort()
+	if err != nil {
+		return "", nil, err
+	}
+	localAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort))
+
+	cmd := exec.Command(path)
+	cmd.Dir = dir
+	cmd.Env = []string{
+		"SS_REMOTE_HOST=" + key.Host,
+		"SS_REMOTE_PORT=" + strconv.Itoa(key.Port),
+		"SS_LOCAL_HOST=127.0.0.1",
+		"SS_LOCAL_PORT=" + strconv.Itoa(localPort),
+		"SS_PLUGIN_OPTIONS=" + plugin.RawOptions,
+		"PATH=" + os.Getenv("PATH"),
+	}
+	configurePluginProcess(cmd)
+	cmd.WaitDelay = externalPluginWaitDelay
+	if err := cmd.Start(); err != nil {
+		return "", nil, fmt.Errorf("failed to start plugin %s: %w", plugin.Name, err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			log.Debugf("plugin %s exited: %v", plugin.Name, err)
+		}
+		close(exited)
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			if err := killPluginProcess(cmd); err != nil && !errors.Is(err, os.ErrProcessDone) {
+				log.Errorf("failed to stop plugin %s: %v", plugin.Name, err)
+			}
+			<-exited
+		})
+	}
+
+	if err := waitForPlugin(ctx, localAddr, exited); err != nil {
+		stop()
+		return "", nil, fmt.Errorf("plugin %s did not start: %w", plugin.Name, err)
+	}
+	return localAddr, stop, nil
+}
+
+// freeLocalPort asks the kernel for a free port on the loopback interface.
+func freeLocalPort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	return port, l.Close()
+}
+
+// waitForPlugin polls the local port of the plugin until it accepts
+// connections, the plugin exits or the start timeout is reached.
+func waitForPlugin(ctx context.Context, addr string, exited <-chan struct{}) error {
+	ctx, cancel := context.WithTimeout(ctx, externalPluginStartTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn.Close()
+		}
+
+		select {
+		case <-exited:
+			return errors.New("plugin exited")
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package ssproxy
+
+import (
+	"os"
+	"os/exec"
+)
+
+// isExecutable always accepts regular files since there are no executable
+// permission bits to check.
+func isExecutable(os.FileInfo) bool {
+	return true
+}
+
+func configurePluginProcess(*exec.Cmd) {}
+
+func killPluginProcess(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
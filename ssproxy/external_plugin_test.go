@@ -0,0 +1,137 @@
+//go:build unix
+
+package ssproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestExternalPluginHelperProcess is not a real test. It is run by the fake
+// plugin script as a SIP003 plugin that forwards connections from
+// SS_LOCAL_HOST:SS_LOCAL_PORT to SS_REMOTE_HOST:SS_REMOTE_PORT.
+func TestExternalPluginHelperProcess(t *testing.T) {
+	if os.Getenv("SHADOWTEST_PLUGIN_HELPER") != "1" {
+		t.Skip("only run as a fake plugin")
+	}
+	err := os.WriteFile(os.Getenv("SHADOWTEST_PLUGIN_OPTIONS_FILE"), []byte(os.Getenv("SS_PLUGIN_OPTIONS")), 0o600)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(os.Getenv("SS_LOCAL_HOST"), os.Getenv("SS_LOCAL_PORT")))
+	if err != nil {
+		os.Exit(1)
+	}
+	remote := net.JoinHostPort(os.Getenv("SS_REMOTE_HOST"), os.Getenv("SS_REMOTE_PORT"))
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			os.Exit(1)
+		}
+		go func() {
+			defer func() { _ = conn.Close() }()
+			rc, err := net.Dial("tcp", remote)
+			if err != nil {
+				return
+			}
+			defer func() { _ = rc.Close() }()
+			go func() { _, _ = io.Copy(rc, conn) }()
+			_, _ = io.Copy(conn, rc)
+		}()
+	}
+}
+
+// writeFakePlugin writes an executable script named name into dir.
+func writeFakePlugin(t *testing.T, dir, name, script string) {
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0o755))
+}
+
+func enableExternalPlugins(t *testing.T, dir string) {
+	require.NoError(t, EnableExternalPlugins(dir))
+	t.Cleanup(func() { _ = EnableExternalPlugins("") })
+}
+
+func TestExternalPlugin(t *testing.T) {
+	testBinary, err := os.Executable()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	optionsFile := filepath.Join(dir, "options")
+	writeFakePlugin(t, dir, "fake-plugin", fmt.Sprintf(
+		"SHADOWTEST_PLUGIN_HELPER=1 SHADOWTEST_PLUGIN_OPTIONS_FILE=%s exec %s -test.run=^TestExternalPluginHelperProcess$",
+		optionsFile, testBinary))
+	enableExternalPlugins(t, dir)
+
+	echo := startTCPServer(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+	key := Key{Host: "127.0.0.1", Port: tcpPort(t, echo), Plugin: "fake-plugin;mode=test;host=example.com"}
+	addr, wrap, stop, err := setupPlugin(t.Context(), key)
+	require.NoError(t, err)
+	assert.Nil(t, wrap)
+	assert.NotEqual(t, key.Addr(), addr)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	response := make([]byte, 4)
+	_, err = io.ReadFull(conn, response)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(response))
+	require.NoError(t, conn.Close())
+
+	options, err := os.ReadFile(optionsFile)
+	require.NoError(t, err)
+	assert.Equal(t, "mode=test;host=example.com", string(options))
+
+	stop()
+	_, err = net.DialTimeout("tcp", addr, time.Second)
+	assert.Error(t, err)
+}
+
+func TestExternalPluginDisabled(t *testing.T) {
+	require.NoError(t, EnableExternalPlugins(""))
+	_, _, _, err := setupPlugin(t.Context(), Key{Host: "127.0.0.1", Port: 8388, Plugin: "v2ray-plugin"})
+	assert.ErrorIs(t, err, errUnsupportedPlugin)
+}
+
+func TestExternalPluginExits(t *testing.T) {
+	dir := t.TempDir()
+	writeFakePlugin(t, dir, "broken-plugin", "exit 1")
+	enableExternalPlugins(t, dir)
+
+	_, _, _, err := setupPlugin(t.Context(), Key{Host: "127.0.0.1", Port: 8388, Plugin: "broken-plugin"})
+	assert.Error(t, err)
+}
+
+func TestExternalPluginPath(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	enableExternalPlugins(t, dir)
+	dir = getExternalPluginDir()
+
+	writeFakePlugin(t, outside, "outside-plugin", "exit 0")
+	require.NoError(t, os.Symlink(filepath.Join(outside, "outside-plugin"), filepath.Join(dir, "linked-plugin")))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "not-executable"), []byte("#!/bin/sh\n"), 0o644))
+	writeFakePlugin(t, dir, "good-plugin", "exit 0")
+
+	_, err := externalPluginPath(dir, "good-plugin")
+	assert.NoError(t, err)
+
+	for _, name := range []string{"", "..", "../outside-plugin", "linked-plugin", "not-executable", "missing-plugin"} {
+		_, err := externalPluginPath(dir, name)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestEnableExternalPluginsInvalidDir(t *testing.T) {
+	assert.Error(t, EnableExternalPlugins(filepath.Join(t.TempDir(), "missing")))
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package ssproxy
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func isExecutable(info os.FileInfo) bool {
+	return info.Mode().Perm()&0o111 != 0
+}
+
+// configurePluginProcess starts the plugin in its own process group so that
+// any process it spawns is stopped with it.
+func configurePluginProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killPluginProcess(cmd *exec.Cmd) error {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package ssproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Family is the address family used to reach the IP info providers through
+// the tunnel, which decides the exit IP that is reported.
+type Family string
+
+const (
+	// FamilyAny lets the server pick the family.
+	FamilyAny  Family = ""
+	FamilyIPv4 Family = "ipv4"
+	FamilyIPv6 Family = "ipv6"
+	// FamilyBoth reports the IPv4 and the IPv6 exit side by side.
+	FamilyBoth Family = "both"
+)
+
+// Validate returns an error for unknown families.
+func (f Family) Validate() error {
+	switch f {
+	case FamilyAny, FamilyIPv4, FamilyIPv6, FamilyBoth:
+		return nil
+	default:
+		return fmt.Errorf("unknown address family %q", string(f))
+	}
+}
+
+// FamilyResult is the exit of one address family when testing both.
+type FamilyResult struct {
+	Success bool `json:"success"`
+	IPInfo
+	Timing Timing `json:"timing"`
+	Stage  Stage  `json:"stage,omitempty"`
+	Code   string `json:"code,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newFamilyResult(ipInfo IPInfo, timing Timing, err error) *FamilyResult {
+	if err == nil {
+		return &FamilyResult{Success: true, IPInfo: ipInfo, Timing: timing}
+	}
+	result := &FamilyResult{Error: err.Error()}
+	var stageErr *StageError
+	if errors.As(err, &stageErr) {
+		result.Stage = stageErr.Stage
+		result.Code = stageErr.Code
+	}
+	return result
+}
+
+// exitLookup is the outcome of getting the exit IP information.
+type exitLookup struct {
+	ipInfo  IPInfo
+	timing  Timing
+	samples *SampleResult
+	err     error
+}
+
+// lookupExit gets the exit IP information for a single family, repeating the
+// request when samples are enabled.
+func lookupExit(ctx context.Context, dialer *shadowDialer, family Family, timeout time.Duration, samples *SampleOptions) exitLookup {
+	var lookup exitLookup
+	if samples != nil {
+		lookup.ipInfo, lookup.timing, lookup.samples, lookup.err = sampleExitIPInfo(ctx, dialer, family, timeout, *samples)
+	} else {
+		lookup.ipInfo, lookup.timing, lookup.err = getExitIPInfo(ctx, dialer, family, timeout)
+	}
+	return lookup
+}
+
+// lookupExitFamilies gets the exit IP information for the family of the
+// options. With FamilyBoth the IPv4 and IPv6 lookups run concurrently and the
+// test only fails when both fail; the IPv4 exit is preferred as the main
+// result and samples only apply to it.
+func lookupExitFamilies(ctx context.Context, dialer *shadowDialer, timeout time.Duration, options Options) (exitLookup, *FamilyResult, *FamilyResult) {
+	if options.Family != FamilyBoth {
+		return lookupExit(ctx, dialer, options.Family, timeout, options.Samples), nil, nil
+	}
+
+	ipv6Lookup := make(chan exitLookup, 1)
+	go func() {
+		ipv6Lookup <- lookupExit(ctx, dialer, FamilyIPv6, timeout, nil)
+	}()
+	ipv4 := lookupExit(ctx, dialer, FamilyIPv4, timeout, options.Samples)
+	ipv6 := <-ipv6Lookup
+
+	ipv4Result := newFamilyResult(ipv4.ipInfo, ipv4.timing, ipv4.err)
+	ipv6Result := newFamilyResult(ipv6.ipInfo, ipv6.timing, ipv6.err)
+	if ipv4.err != nil && ipv6.err == nil {
+		ipv6.samples = ipv4.samples
+		return ipv6, ipv4Result, ipv6Result
+	}
+	return ipv4, ipv4Result, ipv6Result
+}
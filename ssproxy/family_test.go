@@ -0,0 +1,61 @@
+package ssproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFamilyValidate(t *testing.T) {
+	for _, family := range []Family{FamilyAny, FamilyIPv4, FamilyIPv6, FamilyBoth} {
+		assert.NoError(t, family.Validate())
+	}
+	assert.EqualError(t, Family("ipv5").Validate(), `unknown address family "ipv5"`)
+}
+
+func TestNewFamilyResult(t *testing.T) {
+	result := newFamilyResult(IPInfo{IPAddress: "192.0.2.1"}, Timing{Total: 10}, nil)
+	assert.True(t, result.Success)
+	assert.Equal(t, "192.0.2.1", result.IPAddress)
+
+	result = newFamilyResult(IPInfo{}, Timing{}, newStageError(StageUpstream, CodeUpstreamFailed, errors.New("no route")))
+	assert.False(t, result.Success)
+	assert.Equal(t, StageUpstream, result.Stage)
+	assert.Equal(t, CodeUpstreamFailed, result.Code)
+}
+
+func TestLookupExitFamiliesBothFail(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	key := Key{Host: "127.0.0.1", Port: port, Cipher: "chacha20-ietf-poly1305", Password: "password"}
+	dialer, err := newShadowDialer(context.Background(), key)
+	require.NoError(t, err)
+	defer dialer.stop()
+
+	exit, ipv4, ipv6 := lookupExitFamilies(context.Background(), dialer, 5*time.Second, Options{Family: FamilyBoth})
+	assertStageError(t, exit.err, StageConnect, CodeConnectionRefused)
+	require.NotNil(t, ipv4)
+	require.NotNil(t, ipv6)
+	assert.Equal(t, CodeConnectionRefused, ipv4.Code)
+	assert.Equal(t, CodeConnectionRefused, ipv6.Code)
+
+	exit, ipv4, ipv6 = lookupExitFamilies(context.Background(), dialer, 5*time.Second, Options{Family: FamilyIPv6})
+	assert.Error(t, exit.err)
+	assert.Nil(t, ipv4)
+	assert.Nil(t, ipv6)
+}
+
+func TestGetShadowsocksKeyDetailsInvalidFamily(t *testing.T) {
+	key := Key{Host: "127.0.0.1", Port: 8388, Cipher: "chacha20-ietf-poly1305", Password: "password"}
+	_, err := GetShadowsocksKeyDetails(key, 1, Options{Family: "ipv5"})
+	assertStageError(t, err, StageParse, CodeInvalidOptions)
+	assert.ErrorContains(t, err, `unknown address family "ipv5"`)
+}
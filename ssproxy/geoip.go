@@ -0,0 +1,223 @@
+package ssproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/oschwald/maxminddb-golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// GeoIPDatabase enriches IPs from local MaxMind DB files, like the GeoLite2 or
+// DB-IP City and ASN databases. Files that changed are reloaded by Reload or
+// Watch, in the background of the lookups.
+type GeoIPDatabase struct {
+	city *mmdbFile
+	asn  *mmdbFile
+}
+
+// mmdbFile is a MaxMind DB file loaded in memory, so that reloading it never
+// invalidates a reader still in use. The reader is swapped atomically so that
+// lookups never wait for a reload.
+type mmdbFile struct {
+	path   string
+	reader atomic.Pointer[maxminddb.Reader]
+
+	// mu serializes the reloads, modTime and size are those of the last
+	// version read.
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+// geoIPCityRecord holds the fields read from City databases.
+type geoIPCityRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+}
+
+// geoIPASNRecord holds the fields read from ASN databases, and from ISP
+// databases which also name the ISP.
+type geoIPASNRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+	ISP          string `maxminddb:"isp"`
+}
+
+var (
+	geoIPDatabaseMu sync.Mutex
+	geoIPDatabase   *GeoIPDatabase
+)
+
+// OpenGeoIPDatabase opens the City and ASN databases at the paths. Either path
+// can be empty when that database is not available.
+func OpenGeoIPDatabase(cityPath, asnPath string) (*GeoIPDatabase, error) {
+	if cityPath == "" && asnPath == "" {
+		return nil, errors.New("no GeoIP database")
+	}
+	db := &GeoIPDatabase{}
+	for _, file := range []struct {
+		path string
+		dest **mmdbFile
+	}{{cityPath, &db.city}, {asnPath, &db.asn}} {
+		if file.path == "" {
+			continue
+		}
+		f := &mmdbFile{path: file.path}
+		if err := f.load(); err != nil {
+			return nil, err
+		}
+		*file.dest = f
+	}
+	return db, nil
+}
+
+// SetGeoIPDatabase enriches the exit and entry IPs of every test from db.
+// Passing nil stops the enrichment.
+func SetGeoIPDatabase(db *GeoIPDatabase) {
+	geoIPDatabaseMu.Lock()
+	defer geoIPDatabaseMu.Unlock()
+	geoIPDatabase = db
+}
+
+func getGeoIPDatabase() *GeoIPDatabase {
+	geoIPDatabaseMu.Lock()
+	defer geoIPDatabaseMu.Unlock()
+	return geoIPDatabase
+}
+
+// load reads the file if it changed since it was last read.
+func (f *mmdbFile) load() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	loaded := f.reader.Load() != nil
+	if loaded && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return nil
+	}
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	reader, err := maxminddb.FromBytes(b)
+	if err != nil {
+		if loaded {
+			// Keep the previous version until the file changes again.
+			f.modTime, f.size = info.ModTime(), info.Size()
+		}
+		return fmt.Errorf("invalid GeoIP database %s: %w", f.path, err)
+	}
+	f.reader.Store(reader)
+	f.modTime, f.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// current returns the reader of the latest version loaded.
+func (f *mmdbFile) current() *maxminddb.Reader {
+	return f.reader.Load()
+}
+
+// Reload reloads the files that changed since they were last read. Files that
+// cannot be reloaded keep their previous version, and their errors are
+// returned together.
+func (db *GeoIPDatabase) Reload() error {
+	var errs []error
+	for _, f := range []*mmdbFile{db.city, db.asn} {
+		if f == nil {
+			continue
+		}
+		if err := f.load(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Watch reloads the files that changed every interval until the context is
+// done.
+func (db *GeoIPDatabase) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := db.Reload(); err != nil {
+			log.Errorf("unable to reload the GeoIP database: %v", err)
+			sentry.CaptureException(err)
+		}
+	}
+}
+
+// Enrich fills the location and network of info from the databases, keeping
+// the values they do not know.
+func (db *GeoIPDatabase) Enrich(info *IPInfo) error {
+	addr, err := netip.ParseAddr(info.IPAddress)
+	if err != nil {
+		return err
+	}
+	ip := addr.Unmap().AsSlice()
+
+	if db.city != nil {
+		var record geoIPCityRecord
+		if err := db.city.current().Lookup(ip, &record); err != nil {
+			return err
+		}
+		setIfKnown(&info.City, record.City.Names["en"])
+		setIfKnown(&info.Country, record.Country.Names["en"])
+		setIfKnown(&info.CountryCode, record.Country.ISOCode)
+		if record.City.Names["en"] != "" || record.Country.Names["en"] != "" {
+			info.Location = joinLocation(info.City, info.Country)
+		}
+	}
+
+	if db.asn != nil {
+		var record geoIPASNRecord
+		if err := db.asn.current().Lookup(ip, &record); err != nil {
+			return err
+		}
+		if record.Number != 0 {
+			info.ASN = record.Number
+		}
+		setIfKnown(&info.ASOrganization, record.Organization)
+		setIfKnown(&info.ISP, record.ISP)
+		if record.ISP == "" {
+			setIfKnown(&info.ISP, record.Organization)
+		}
+	}
+	return nil
+}
+
+func setIfKnown(field *string, value string) {
+	if value != "" {
+		*field = value
+	}
+}
+
+// enrichIPInfo enriches info from the GeoIP database when there is one.
+func enrichIPInfo(info *IPInfo) {
+	db := getGeoIPDatabase()
+	if db == nil || info.IPAddress == "" {
+		return
+	}
+	if err := db.Enrich(info); err != nil {
+		log.Warnf("unable to look up %s in the GeoIP database: %v", info.IPAddress, err)
+	}
+}
@@ -0,0 +1,260 @@
+package ssproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mmdbNode is a node of the search tree of a MaxMind DB. Leaves have data.
+type mmdbNode struct {
+	children [2]*mmdbNode
+	data     []byte
+}
+
+// writeMMDB writes an IPv4 MaxMind DB mapping the prefixes to the records.
+func writeMMDB(t *testing.T, path, databaseType string, records map[netip.Prefix]map[string]any) {
+	root := &mmdbNode{}
+	for prefix, record := range records {
+		node := root
+		ip := prefix.Addr().As4()
+		for i := range prefix.Bits() {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &mmdbNode{}
+			}
+			node = node.children[bit]
+		}
+		node.data = mmdbEncode(record)
+	}
+
+	var nodes []*mmdbNode
+	index := map[*mmdbNode]int{}
+	for queue := []*mmdbNode{root}; len(queue) > 0; queue = queue[1:] {
+		index[queue[0]] = len(nodes)
+		nodes = append(nodes, queue[0])
+		for _, child := range queue[0].children {
+			if child != nil && child.data == nil {
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	var tree, data []byte
+	for _, node := range nodes {
+		for _, child := range node.children {
+			record := len(nodes)
+			switch {
+			case child == nil:
+			case child.data != nil:
+				record = len(nodes) + 16 + len(data)
+				data = append(data, child.data...)
+			default:
+				record = index[child]
+			}
+			tree = append(tree, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+
+	file := slices.Concat(tree, make([]byte, 16), data, []byte("\xab\xcd\xefMaxMind.com"), mmdbEncode(map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(time.Now().Unix()),
+		"database_type":               databaseType,
+		"description":                 map[string]any{},
+		"ip_version":                  uint16(4),
+		"languages":                   []any{"en"},
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(24),
+	}))
+	require.NoError(t, os.WriteFile(path, file, 0o644))
+}
+
+// mmdbEncode encodes a value in the data section format of MaxMind DB.
+func mmdbEncode(value any) []byte {
+	switch value := value.(type) {
+	case string:
+		return append(mmdbControl(2, len(value)), value...)
+	case uint16:
+		return mmdbUint(5, uint64(value))
+	case uint32:
+		return mmdbUint(6, uint64(value))
+	case uint64:
+		return mmdbUint(9, value)
+	case []any:
+		b := mmdbControl(11, len(value))
+		for _, item := range value {
+			b = append(b, mmdbEncode(item)...)
+		}
+		return b
+	case map[string]any:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		b := mmdbControl(7, len(value))
+		for _, key := range keys {
+			b = append(b, mmdbEncode(key)...)
+			b = append(b, mmdbEncode(value[key])...)
+		}
+		return b
+	default:
+		panic("unsupported type")
+	}
+}
+
+func mmdbUint(typ int, value uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], value)
+	trimmed := b[:]
+	for len(trimmed) > 0 && trimmed[0] == 0 {
+		trimmed = trimmed[1:]
+	}
+	return append(mmdbControl(typ, len(trimmed)), trimmed...)
+}
+
+// mmdbControl returns the control bytes of a value of the type and size, which
+// must be lower than 285.
+func mmdbControl(typ, size int) []byte {
+	var extension []byte
+	if size >= 29 {
+		extension = []byte{byte(size - 29)}
+		size = 29
+	}
+	if typ > 7 {
+		return append([]byte{byte(size), byte(typ - 7)}, extension...)
+	}
+	return append([]byte{byte(typ<<5 | size)}, extension...)
+}
+
+func writeTestGeoIPDatabases(t *testing.T, city string) (string, string) {
+	dir := t.TempDir()
+	cityPath := filepath.Join(dir, "city.mmdb")
+	asnPath := filepath.Join(dir, "asn.mmdb")
+	writeMMDB(t, cityPath, "GeoLite2-City", map[netip.Prefix]map[string]any{
+		netip.MustParsePrefix("192.0.2.0/24"): {
+			"city":    map[string]any{"names": map[string]any{"en": city}},
+			"country": map[string]any{"iso_code": "DE", "names": map[string]any{"en": "Germany"}},
+		},
+	})
+	writeMMDB(t, asnPath, "GeoLite2-ASN", map[netip.Prefix]map[string]any{
+		netip.MustParsePrefix("192.0.2.0/25"): {
+			"autonomous_system_number":       uint32(64500),
+			"autonomous_system_organization": "Example GmbH",
+		},
+	})
+	return cityPath, asnPath
+}
+
+func TestGeoIPDatabaseEnrich(t *testing.T) {
+	cityPath, asnPath := writeTestGeoIPDatabases(t, "Berlin")
+	db, err := OpenGeoIPDatabase(cityPath, asnPath)
+	require.NoError(t, err)
+
+	info := IPInfo{IPAddress: "192.0.2.1", Provider: "echo"}
+	require.NoError(t, db.Enrich(&info))
+	assert.Equal(t, IPInfo{
+		IPAddress:      "192.0.2.1",
+		Location:       "Berlin, Germany",
+		ISP:            "Example GmbH",
+		CountryCode:    "DE",
+		City:           "Berlin",
+		Country:        "Germany",
+		ASN:            64500,
+		ASOrganization: "Example GmbH",
+		Provider:       "echo",
+	}, info)
+
+	info = IPInfo{IPAddress: "192.0.2.200", ISP: "Known ISP"}
+	require.NoError(t, db.Enrich(&info))
+	assert.Equal(t, "Berlin", info.City)
+	assert.Equal(t, "Known ISP", info.ISP)
+	assert.Zero(t, info.ASN)
+
+	info = IPInfo{IPAddress: "198.51.100.1", City: "Paris"}
+	require.NoError(t, db.Enrich(&info))
+	assert.Equal(t, IPInfo{IPAddress: "198.51.100.1", City: "Paris"}, info)
+
+	assert.Error(t, db.Enrich(&IPInfo{IPAddress: "invalid"}))
+}
+
+func TestGeoIPDatabaseReload(t *testing.T) {
+	cityPath, _ := writeTestGeoIPDatabases(t, "Berlin")
+	db, err := OpenGeoIPDatabase(cityPath, "")
+	require.NoError(t, err)
+
+	info := IPInfo{IPAddress: "192.0.2.1"}
+	require.NoError(t, db.Enrich(&info))
+	assert.Equal(t, "Berlin", info.City)
+
+	updatedPath, _ := writeTestGeoIPDatabases(t, "Hamburg")
+	require.NoError(t, os.Rename(updatedPath, cityPath))
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(cityPath, future, future))
+
+	// Lookups never reload the files themselves.
+	info = IPInfo{IPAddress: "192.0.2.1"}
+	require.NoError(t, db.Enrich(&info))
+	assert.Equal(t, "Berlin", info.City)
+
+	require.NoError(t, db.Reload())
+	info = IPInfo{IPAddress: "192.0.2.1"}
+	require.NoError(t, db.Enrich(&info))
+	assert.Equal(t, "Hamburg", info.City)
+
+	// A broken update keeps the previous database.
+	require.NoError(t, os.WriteFile(cityPath, []byte("invalid"), 0o644))
+	assert.ErrorContains(t, db.Reload(), "invalid GeoIP database")
+	info = IPInfo{IPAddress: "192.0.2.1"}
+	require.NoError(t, db.Enrich(&info))
+	assert.Equal(t, "Hamburg", info.City)
+	assert.NoError(t, db.Reload())
+}
+
+func TestGeoIPDatabaseWatch(t *testing.T) {
+	cityPath, _ := writeTestGeoIPDatabases(t, "Berlin")
+	db, err := OpenGeoIPDatabase(cityPath, "")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	watching := make(chan struct{})
+	go func() {
+		db.Watch(ctx, 10*time.Millisecond)
+		close(watching)
+	}()
+	defer func() {
+		cancel()
+		<-watching
+	}()
+
+	updatedPath, _ := writeTestGeoIPDatabases(t, "Hamburg")
+	require.NoError(t, os.Rename(updatedPath, cityPath))
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(cityPath, future, future))
+
+	assert.Eventually(t, func() bool {
+		info := IPInfo{IPAddress: "192.0.2.1"}
+		return db.Enrich(&info) == nil && info.City == "Hamburg"
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestOpenGeoIPDatabaseErrors(t *testing.T) {
+	_, err := OpenGeoIPDatabase("", "")
+	assert.Error(t, err)
+
+	_, err = OpenGeoIPDatabase(filepath.Join(t.TempDir(), "missing.mmdb"), "")
+	assert.Error(t, err)
+
+	invalid := filepath.Join(t.TempDir(), "invalid.mmdb")
+	require.NoError(t, os.WriteFile(invalid, []byte("invalid"), 0o644))
+	_, err = OpenGeoIPDatabase("", invalid)
+	assert.ErrorContains(t, err, "invalid GeoIP database")
+}
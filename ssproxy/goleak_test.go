@@ -1,6 +1,7 @@
 package ssproxy
 
 import (
+	"os"
 	"testing"
 
 	"go.uber.org/goleak"
@@ -11,5 +12,8 @@ import (
 // ListenForOneConnection and the bidirectional copy goroutines started by
 // relay) fails the package instead of silently piling up.
 func TestMain(m *testing.M) {
+	// The clients and the test servers share the process wide salt filter of
+	// go-shadowsocks2, which would reject the salts of each other.
+	_ = os.Setenv("SHADOWSOCKS_SF_CAPACITY", "-1")
 	goleak.VerifyTestMain(m)
 }
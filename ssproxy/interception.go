@@ -0,0 +1,136 @@
+package ssproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxTLSChecks = 5
+
+// TLSCheck records the certificate chain served for Host through the tunnel.
+// The chain is compared to Pins, base64 SHA-256 hashes of the Subject Public
+// Key Info of any certificate of the chain optionally prefixed with
+// "sha256/", or to the system roots when there are no pins.
+type TLSCheck struct {
+	// Host is a hostname, with an optional port defaulting to 443.
+	Host string   `json:"host"`
+	Pins []string `json:"pins,omitempty"`
+}
+
+// TLSCheckResult is the outcome of a TLSCheck. Intercepted is set when the
+// chain does not match the pins or, without pins, is not trusted.
+type TLSCheckResult struct {
+	Host        string            `json:"host"`
+	Intercepted bool              `json:"intercepted"`
+	Trusted     bool              `json:"trusted"`
+	PinMatched  *bool             `json:"pin_matched,omitempty"`
+	Chain       []CertificateInfo `json:"chain,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// CertificateInfo describes a certificate of the chain.
+type CertificateInfo struct {
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	SPKI     string    `json:"spki_sha256"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// spkiHash returns the base64 SHA-256 hash of the public key of cert, the
+// format used for pins.
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// checkTLSInterception runs the checks concurrently through the tunnel and
+// returns the results in the same order. The chains are verified against roots,
+// or the system roots when it is nil.
+func checkTLSInterception(ctx context.Context, dialer *shadowDialer, checks []TLSCheck, timeout time.Duration, roots *x509.CertPool) []TLSCheckResult {
+	results := make([]TLSCheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		if i >= maxTLSChecks {
+			results[i] = TLSCheckResult{Host: check.Host, Error: fmt.Sprintf("only %d hosts can be checked", maxTLSChecks)}
+			continue
+		}
+		wg.Go(func() {
+			results[i] = checkTLSHost(ctx, dialer, check, timeout, roots)
+		})
+	}
+	wg.Wait()
+	return results
+}
+
+func checkTLSHost(ctx context.Context, dialer *shadowDialer, check TLSCheck, timeout time.Duration, roots *x509.CertPool) TLSCheckResult {
+	result := TLSCheckResult{Host: check.Host}
+	address := check.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "443")
+	}
+	serverName, _, err := net.SplitHostPort(address)
+	if err != nil || serverName == "" {
+		result.Error = fmt.Sprintf("invalid host %q", check.Host)
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, closeConn, err := dialTarget(ctx, dialer, address)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer closeConn()
+
+	// The chain is checked below, after the handshake, so that it is recorded
+	// even when it is not valid.
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	certificates := tlsConn.ConnectionState().PeerCertificates
+	_ = tlsConn.Close()
+
+	spkis := map[string]bool{}
+	for _, cert := range certificates {
+		spki := spkiHash(cert)
+		spkis[spki] = true
+		result.Chain = append(result.Chain, CertificateInfo{
+			Subject:  cert.Subject.String(),
+			Issuer:   cert.Issuer.String(),
+			SPKI:     spki,
+			NotAfter: cert.NotAfter,
+		})
+	}
+
+	verifyErr := verifyChain(certificates, serverName, roots)
+	result.Trusted = verifyErr == nil
+	if len(check.Pins) == 0 {
+		result.Intercepted = !result.Trusted
+		if verifyErr != nil {
+			result.Error = verifyErr.Error()
+		}
+		return result
+	}
+
+	matched := false
+	for _, pin := range check.Pins {
+		if spkis[strings.TrimPrefix(pin, "sha256/")] {
+			matched = true
+			break
+		}
+	}
+	result.PinMatched = &matched
+	result.Intercepted = !matched
+	return result
+}
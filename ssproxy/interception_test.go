@@ -0,0 +1,71 @@
+package ssproxy
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckTLSInterception(t *testing.T) {
+	dialer := newTestDialer(t)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+	pin := spkiHash(server.Certificate())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	results := checkTLSInterception(context.Background(), dialer, []TLSCheck{
+		{Host: host},
+		{Host: host, Pins: []string{"sha256/" + pin}},
+		{Host: host, Pins: []string{"c2hhZG93dGVzdA=="}},
+	}, 5*time.Second, roots)
+	require.Len(t, results, 3)
+
+	assert.False(t, results[0].Intercepted, results[0].Error)
+	assert.True(t, results[0].Trusted)
+	assert.Nil(t, results[0].PinMatched)
+	require.Len(t, results[0].Chain, 1)
+	assert.Equal(t, pin, results[0].Chain[0].SPKI)
+	assert.Equal(t, "O=Acme Co", results[0].Chain[0].Subject)
+
+	require.NotNil(t, results[1].PinMatched)
+	assert.True(t, *results[1].PinMatched)
+	assert.False(t, results[1].Intercepted)
+
+	require.NotNil(t, results[2].PinMatched)
+	assert.False(t, *results[2].PinMatched)
+	assert.True(t, results[2].Intercepted)
+}
+
+func TestCheckTLSInterceptionUntrusted(t *testing.T) {
+	dialer := newTestDialer(t)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	results := checkTLSInterception(context.Background(), dialer, []TLSCheck{{Host: host}}, 5*time.Second, x509.NewCertPool())
+	require.Len(t, results, 1)
+	assert.True(t, results[0].Intercepted)
+	assert.False(t, results[0].Trusted)
+	assert.NotEmpty(t, results[0].Error)
+	assert.Len(t, results[0].Chain, 1)
+}
+
+func TestCheckTLSInterceptionInvalid(t *testing.T) {
+	checks := make([]TLSCheck, maxTLSChecks+1)
+	for i := range checks {
+		checks[i] = TLSCheck{Host: ":443"}
+	}
+	results := checkTLSInterception(context.Background(), nil, checks, time.Second, nil)
+	assert.Equal(t, `invalid host ":443"`, results[0].Error)
+	assert.Equal(t, "only 5 hosts can be checked", results[maxTLSChecks].Error)
+}
@@ -0,0 +1,415 @@
+package ssproxy
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// IPInfoProvider is a service describing the IP of its clients, queried
+// through the tunnel to find the exit IP of a key.
+type IPInfoProvider interface {
+	// Name identifies the provider in the results.
+	Name() string
+	// URL returns the endpoint only reachable over the family, or an empty
+	// string when the provider cannot be reached over it.
+	URL(family Family) string
+	// Decode reads the response of the endpoint.
+	Decode(body []byte) (IPInfo, error)
+}
+
+// healthChecker is implemented by providers with an endpoint dedicated to
+// checking that they are up.
+type healthChecker interface {
+	HealthURL() string
+}
+
+// FamilyURLs are the endpoints of a provider for each address family. IPv4 and
+// IPv6 must only be reachable over that family.
+type FamilyURLs struct {
+	Any  string `json:"any"`
+	IPv4 string `json:"ipv4,omitempty"`
+	IPv6 string `json:"ipv6,omitempty"`
+}
+
+func (u FamilyURLs) url(family Family) string {
+	switch family {
+	case FamilyIPv4:
+		return u.IPv4
+	case FamilyIPv6:
+		return u.IPv6
+	default:
+		return u.Any
+	}
+}
+
+// R4bbitProvider queries ip.r4bbit.net, which answers in the IPInfo format.
+type R4bbitProvider struct {
+	URLs   FamilyURLs
+	Health string
+}
+
+// NewR4bbitProvider returns the provider of the public r4bbit endpoints.
+func NewR4bbitProvider() *R4bbitProvider {
+	return &R4bbitProvider{
+		URLs: FamilyURLs{
+			Any:  "https://ip.r4bbit.net/json",
+			IPv4: "https://ipv4.r4bbit.net/json",
+			IPv6: "https://ipv6.r4bbit.net/json",
+		},
+		Health: "https://ip.r4bbit.net/health",
+	}
+}
+
+func (p *R4bbitProvider) Name() string             { return "r4bbit" }
+func (p *R4bbitProvider) URL(family Family) string { return p.URLs.url(family) }
+func (p *R4bbitProvider) HealthURL() string        { return p.Health }
+
+func (p *R4bbitProvider) Decode(body []byte) (IPInfo, error) {
+	return decodeIPInfo(body)
+}
+
+// decodeIPInfo reads a response in the IPInfo format.
+func decodeIPInfo(body []byte) (IPInfo, error) {
+	var info IPInfo
+	err := json.Unmarshal(body, &info)
+	return info, err
+}
+
+// IPInfoIOProvider queries ipinfo.io.
+type IPInfoIOProvider struct {
+	URLs FamilyURLs
+}
+
+// NewIPInfoIOProvider returns the provider of the public ipinfo.io endpoints.
+func NewIPInfoIOProvider() *IPInfoIOProvider {
+	return &IPInfoIOProvider{
+		URLs: FamilyURLs{
+			Any:  "https://ipinfo.io/json",
+			IPv4: "https://ipv4.ipinfo.io/json",
+			IPv6: "https://v6.ipinfo.io/json",
+		},
+	}
+}
+
+func (p *IPInfoIOProvider) Name() string             { return "ipinfo" }
+func (p *IPInfoIOProvider) URL(family Family) string { return p.URLs.url(family) }
+
+func (p *IPInfoIOProvider) Decode(body []byte) (IPInfo, error) {
+	var data struct {
+		IP      string `json:"ip"`
+		City    string `json:"city"`
+		Region  string `json:"region"`
+		Country string `json:"country"`
+		Org     string `json:"org"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return IPInfo{}, err
+	}
+	asn, asOrganization := parseAS(data.Org)
+	// ipinfo.io only returns the country code, the name is looked up.
+	country := countryName(data.Country)
+	var location []string
+	for _, part := range []string{data.City, data.Region, cmp.Or(country, data.Country)} {
+		if part != "" {
+			location = append(location, part)
+		}
+	}
+	return IPInfo{
+		IPAddress:      data.IP,
+		Location:       strings.Join(location, ", "),
+		ISP:            data.Org,
+		CountryCode:    data.Country,
+		City:           data.City,
+		Country:        country,
+		ASN:            asn,
+		ASOrganization: asOrganization,
+	}, nil
+}
+
+// IPAPIProvider queries ip-api.com, which is only reachable over IPv4.
+type IPAPIProvider struct {
+	URLs FamilyURLs
+}
+
+// NewIPAPIProvider returns the provider of the public ip-api.com endpoint.
+func NewIPAPIProvider() *IPAPIProvider {
+	return &IPAPIProvider{
+		URLs: FamilyURLs{
+			Any:  "http://ip-api.com/json?fields=status,message,country,countryCode,city,isp,as,query",
+			IPv4: "http://ip-api.com/json?fields=status,message,country,countryCode,city,isp,as,query",
+		},
+	}
+}
+
+func (p *IPAPIProvider) Name() string             { return "ip-api" }
+func (p *IPAPIProvider) URL(family Family) string { return p.URLs.url(family) }
+
+func (p *IPAPIProvider) Decode(body []byte) (IPInfo, error) {
+	return decodeIPAPI(body)
+}
+
+// ipAPIResponse is the answer of ip-api.com.
+type ipAPIResponse struct {
+	Status      string `json:"status"`
+	Message     string `json:"message"`
+	Query       string `json:"query"`
+	Country     string `json:"country"`
+	CountryCode string `json:"countryCode"`
+	City        string `json:"city"`
+	ISP         string `json:"isp"`
+	AS          string `json:"as"`
+}
+
+// decodeIPAPI reads an ip-api.com response.
+func decodeIPAPI(body []byte) (IPInfo, error) {
+	var data ipAPIResponse
+	if err := json.Unmarshal(body, &data); err != nil {
+		return IPInfo{}, err
+	}
+	if data.Status != "success" {
+		if data.Message == "" {
+			return IPInfo{}, errors.New("the lookup failed")
+		}
+		return IPInfo{}, errors.New(data.Message)
+	}
+	asn, asOrganization := parseAS(data.AS)
+	info := IPInfo{
+		IPAddress:      data.Query,
+		Location:       joinLocation(data.City, data.Country),
+		ISP:            data.ISP,
+		CountryCode:    data.CountryCode,
+		City:           data.City,
+		Country:        data.Country,
+		ASN:            asn,
+		ASOrganization: asOrganization,
+	}
+	return info, nil
+}
+
+// parseAS splits an autonomous system given as "AS64500 Example" into its
+// number and organization.
+func parseAS(as string) (uint, string) {
+	number, organization, _ := strings.Cut(as, " ")
+	asn, err := strconv.ParseUint(strings.TrimPrefix(number, "AS"), 10, 32)
+	if err != nil || !strings.HasPrefix(number, "AS") {
+		return 0, ""
+	}
+	return uint(asn), organization
+}
+
+// countryName returns the English name of the country with the ISO code, or
+// an empty string when it is unknown.
+func countryName(code string) string {
+	if names := countryNames[strings.ToUpper(code)]; len(names) > 0 {
+		return names[0]
+	}
+	return ""
+}
+
+// joinLocation formats a location like the r4bbit service does.
+func joinLocation(city, country string) string {
+	switch {
+	case city == "":
+		return country
+	case country == "":
+		return city
+	default:
+		return city + ", " + country
+	}
+}
+
+// WTFIsMyIPProvider queries wtfismyip.com.
+type WTFIsMyIPProvider struct {
+	URLs FamilyURLs
+}
+
+// NewWTFIsMyIPProvider returns the provider of the public wtfismyip.com
+// endpoints.
+func NewWTFIsMyIPProvider() *WTFIsMyIPProvider {
+	return &WTFIsMyIPProvider{
+		URLs: FamilyURLs{
+			Any:  "https://wtfismyip.com/json",
+			IPv4: "https://ipv4.wtfismyip.com/json",
+			IPv6: "https://ipv6.wtfismyip.com/json",
+		},
+	}
+}
+
+func (p *WTFIsMyIPProvider) Name() string             { return "wtfismyip" }
+func (p *WTFIsMyIPProvider) URL(family Family) string { return p.URLs.url(family) }
+
+func (p *WTFIsMyIPProvider) Decode(body []byte) (IPInfo, error) {
+	var data struct {
+		IPAddress   string `json:"YourFuckingIPAddress"`
+		Location    string `json:"YourFuckingLocation"`
+		ISP         string `json:"YourFuckingISP"`
+		TorExit     bool   `json:"YourFuckingTorExit"`
+		CountryCode string `json:"YourFuckingCountryCode"`
+		City        string `json:"YourFuckingCity"`
+		Country     string `json:"YourFuckingCountry"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return IPInfo{}, err
+	}
+	return IPInfo{
+		IPAddress:   data.IPAddress,
+		Location:    data.Location,
+		ISP:         data.ISP,
+		TorExit:     data.TorExit,
+		CountryCode: data.CountryCode,
+		City:        data.City,
+		Country:     data.Country,
+	}, nil
+}
+
+// JSONProvider queries any service answering with a JSON object, reading the
+// IPInfo fields from the keys named in Fields.
+type JSONProvider struct {
+	ProviderName string     `json:"name"`
+	URLs         FamilyURLs `json:"urls"`
+	Fields       JSONFields `json:"fields"`
+}
+
+// JSONFields maps the IPInfo fields to keys of the response, with dots
+// separating the keys of nested objects. Unmapped fields are left empty.
+type JSONFields struct {
+	IPAddress   string `json:"ip_address"`
+	Location    string `json:"location,omitempty"`
+	ISP         string `json:"isp,omitempty"`
+	TorExit     string `json:"tor_exit,omitempty"`
+	CountryCode string `json:"country_code,omitempty"`
+	City        string `json:"city,omitempty"`
+	Country     string `json:"country,omitempty"`
+	// ASN may be prefixed with "AS".
+	ASN            string `json:"asn,omitempty"`
+	ASOrganization string `json:"as_organization,omitempty"`
+}
+
+func (p *JSONProvider) Name() string             { return p.ProviderName }
+func (p *JSONProvider) URL(family Family) string { return p.URLs.url(family) }
+
+func (p *JSONProvider) Decode(body []byte) (IPInfo, error) {
+	decoder := json.NewDecoder(strings.NewReader(string(body)))
+	decoder.UseNumber()
+	var data map[string]any
+	if err := decoder.Decode(&data); err != nil {
+		return IPInfo{}, err
+	}
+	torExit, _ := strconv.ParseBool(jsonField(data, p.Fields.TorExit))
+	asn, _ := strconv.ParseUint(strings.TrimPrefix(jsonField(data, p.Fields.ASN), "AS"), 10, 32)
+	return IPInfo{
+		IPAddress:      jsonField(data, p.Fields.IPAddress),
+		Location:       jsonField(data, p.Fields.Location),
+		ISP:            jsonField(data, p.Fields.ISP),
+		TorExit:        torExit,
+		CountryCode:    jsonField(data, p.Fields.CountryCode),
+		City:           jsonField(data, p.Fields.City),
+		Country:        jsonField(data, p.Fields.Country),
+		ASN:            uint(asn),
+		ASOrganization: jsonField(data, p.Fields.ASOrganization),
+	}, nil
+}
+
+// jsonField returns the value at the dotted path of data as a string, or an
+// empty string when there is none.
+func jsonField(data map[string]any, path string) string {
+	if path == "" {
+		return ""
+	}
+	var value any = data
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return ""
+		}
+		value = object[key]
+	}
+	switch value := value.(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		return ""
+	}
+}
+
+var (
+	ipInfoProvidersMu sync.Mutex
+	ipInfoProviders   = DefaultIPInfoProviders()
+)
+
+// DefaultIPInfoProviders returns the public providers in the order they are
+// tried by default.
+func DefaultIPInfoProviders() []IPInfoProvider {
+	return []IPInfoProvider{NewR4bbitProvider(), NewIPInfoIOProvider(), NewIPAPIProvider(), NewWTFIsMyIPProvider()}
+}
+
+// NewIPInfoProviders returns the providers named in names, in the same order.
+// Names are those of the built-in providers or of the custom providers.
+func NewIPInfoProviders(names []string, custom ...IPInfoProvider) ([]IPInfoProvider, error) {
+	available := map[string]IPInfoProvider{}
+	for _, provider := range DefaultIPInfoProviders() {
+		available[provider.Name()] = provider
+	}
+	for _, provider := range custom {
+		if jsonProvider, ok := provider.(*JSONProvider); ok {
+			if jsonProvider.ProviderName == "" || jsonProvider.URLs.Any == "" || jsonProvider.Fields.IPAddress == "" {
+				return nil, errors.New("custom providers need a name, an URL and the field of the IP address")
+			}
+		}
+		available[provider.Name()] = provider
+	}
+
+	var providers []IPInfoProvider
+	for _, name := range names {
+		provider, ok := available[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown IP info provider %q", strings.TrimSpace(name))
+		}
+		providers = append(providers, provider)
+	}
+	if len(providers) == 0 {
+		return nil, errors.New("no IP info provider")
+	}
+	return providers, nil
+}
+
+// SetIPInfoProviders sets the providers tried in order to find the exit IP of
+// keys. Passing no provider restores the default ones.
+func SetIPInfoProviders(providers ...IPInfoProvider) {
+	if len(providers) == 0 {
+		providers = DefaultIPInfoProviders()
+	}
+	ipInfoProvidersMu.Lock()
+	defer ipInfoProvidersMu.Unlock()
+	ipInfoProviders = providers
+}
+
+// IPInfoProviders returns the providers tried to find the exit IP of keys.
+func IPInfoProviders() []IPInfoProvider {
+	ipInfoProvidersMu.Lock()
+	defer ipInfoProvidersMu.Unlock()
+	return ipInfoProviders
+}
+
+// IPInfoHealthURLs returns the URLs checked to tell whether the providers are
+// reachable from this host.
+func IPInfoHealthURLs() []string {
+	var urls []string
+	for _, provider := range IPInfoProviders() {
+		if checker, ok := provider.(healthChecker); ok && checker.HealthURL() != "" {
+			urls = append(urls, checker.HealthURL())
+		} else if url := provider.URL(FamilyAny); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
@@ -0,0 +1,177 @@
+package ssproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useIPInfoProviders replaces the providers for the duration of the test.
+func useIPInfoProviders(t *testing.T, providers ...IPInfoProvider) {
+	SetIPInfoProviders(providers...)
+	t.Cleanup(func() { SetIPInfoProviders() })
+}
+
+// newIPInfoServer answers every request with status and body.
+func newIPInfoServer(t *testing.T, status int, body string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFamilyURLs(t *testing.T) {
+	provider := NewR4bbitProvider()
+	assert.Equal(t, "https://ip.r4bbit.net/json", provider.URL(FamilyAny))
+	assert.Equal(t, "https://ipv4.r4bbit.net/json", provider.URL(FamilyIPv4))
+	assert.Equal(t, "https://ipv6.r4bbit.net/json", provider.URL(FamilyIPv6))
+	assert.Empty(t, NewIPAPIProvider().URL(FamilyIPv6))
+	assert.Equal(t, "https://ipv4.ipinfo.io/json", NewIPInfoIOProvider().URL(FamilyIPv4))
+	assert.Equal(t, "https://v6.ipinfo.io/json", NewIPInfoIOProvider().URL(FamilyIPv6))
+}
+
+func TestIPInfoProvidersDecode(t *testing.T) {
+	expected := IPInfo{IPAddress: "192.0.2.1", Location: "Berlin, Germany", ISP: "Example", CountryCode: "DE", City: "Berlin", Country: "Germany"}
+
+	info, err := NewR4bbitProvider().Decode([]byte(`{"IPAddress":"192.0.2.1","Location":"Berlin, Germany","ISP":"Example","TorExit":false,"CountryCode":"DE","City":"Berlin","Country":"Germany"}`))
+	require.NoError(t, err)
+	assert.Equal(t, expected, info)
+
+	info, err = NewWTFIsMyIPProvider().Decode([]byte(`{"YourFuckingIPAddress":"192.0.2.1","YourFuckingLocation":"Berlin, Germany","YourFuckingISP":"Example","YourFuckingTorExit":false,"YourFuckingCountryCode":"DE","YourFuckingCity":"Berlin","YourFuckingCountry":"Germany"}`))
+	require.NoError(t, err)
+	assert.Equal(t, expected, info)
+
+	info, err = NewIPAPIProvider().Decode([]byte(`{"status":"success","country":"Germany","countryCode":"DE","city":"Berlin","isp":"Example","as":"AS64500 Example","query":"192.0.2.1"}`))
+	require.NoError(t, err)
+	expected.ASN, expected.ASOrganization = 64500, "Example"
+	assert.Equal(t, expected, info)
+
+	_, err = NewIPAPIProvider().Decode([]byte(`{"status":"fail","message":"reserved range"}`))
+	assert.EqualError(t, err, "reserved range")
+
+	info, err = NewIPInfoIOProvider().Decode([]byte(`{"ip":"192.0.2.1","city":"Berlin","region":"Berlin","country":"DE","org":"AS64500 Example"}`))
+	require.NoError(t, err)
+	assert.Equal(t, IPInfo{IPAddress: "192.0.2.1", Location: "Berlin, Berlin, Germany", ISP: "AS64500 Example", CountryCode: "DE", City: "Berlin", Country: "Germany", ASN: 64500, ASOrganization: "Example"}, info)
+
+	info, err = NewIPInfoIOProvider().Decode([]byte(`{"ip":"192.0.2.1","country":"ZZ"}`))
+	require.NoError(t, err)
+	assert.Equal(t, IPInfo{IPAddress: "192.0.2.1", Location: "ZZ", CountryCode: "ZZ"}, info)
+}
+
+func TestParseAS(t *testing.T) {
+	asn, organization := parseAS("AS64500 Example GmbH")
+	assert.Equal(t, uint(64500), asn)
+	assert.Equal(t, "Example GmbH", organization)
+
+	asn, organization = parseAS("Example GmbH")
+	assert.Zero(t, asn)
+	assert.Empty(t, organization)
+}
+
+func TestJSONProviderDecode(t *testing.T) {
+	provider := &JSONProvider{
+		ProviderName: "custom",
+		URLs:         FamilyURLs{Any: "https://example.com/ip"},
+		Fields: JSONFields{
+			IPAddress:   "ip",
+			ISP:         "network.name",
+			ASN:         "network.asn",
+			TorExit:     "flags.tor",
+			CountryCode: "location.country.code",
+			City:        "location.city",
+			Country:     "location.missing",
+		},
+	}
+	info, err := provider.Decode([]byte(`{"ip":"192.0.2.1","network":{"asn":64500,"name":"Example"},"flags":{"tor":true},"location":{"city":"Berlin","country":{"code":"DE"}}}`))
+	require.NoError(t, err)
+	assert.Equal(t, IPInfo{IPAddress: "192.0.2.1", ISP: "Example", TorExit: true, CountryCode: "DE", City: "Berlin", ASN: 64500}, info)
+
+	_, err = provider.Decode([]byte(`[]`))
+	assert.Error(t, err)
+}
+
+func TestNewIPInfoProviders(t *testing.T) {
+	custom := &JSONProvider{ProviderName: "custom", URLs: FamilyURLs{Any: "https://example.com/ip"}, Fields: JSONFields{IPAddress: "ip"}}
+	providers, err := NewIPInfoProviders([]string{"wtfismyip", " custom", "r4bbit"}, custom)
+	require.NoError(t, err)
+	require.Len(t, providers, 3)
+	assert.Equal(t, "wtfismyip", providers[0].Name())
+	assert.Equal(t, "custom", providers[1].Name())
+	assert.Equal(t, "r4bbit", providers[2].Name())
+
+	_, err = NewIPInfoProviders([]string{"unknown"})
+	assert.EqualError(t, err, `unknown IP info provider "unknown"`)
+	_, err = NewIPInfoProviders([]string{"custom"}, &JSONProvider{ProviderName: "custom"})
+	assert.Error(t, err)
+}
+
+func TestIPInfoHealthURLs(t *testing.T) {
+	useIPInfoProviders(t, NewR4bbitProvider(), NewIPAPIProvider())
+	assert.Equal(t, []string{"https://ip.r4bbit.net/health", NewIPAPIProvider().URL(FamilyAny)}, IPInfoHealthURLs())
+}
+
+func TestGetExitIPInfoFallback(t *testing.T) {
+	down := newIPInfoServer(t, http.StatusServiceUnavailable, "down")
+	invalid := newIPInfoServer(t, http.StatusOK, `{"unexpected":true}`)
+	up := newIPInfoServer(t, http.StatusOK, `{"YourFuckingIPAddress":"192.0.2.1","YourFuckingCountryCode":"DE"}`)
+	useIPInfoProviders(t,
+		&R4bbitProvider{URLs: FamilyURLs{Any: down.URL}},
+		&IPAPIProvider{URLs: FamilyURLs{Any: invalid.URL}},
+		&IPInfoIOProvider{URLs: FamilyURLs{IPv6: up.URL}},
+		&WTFIsMyIPProvider{URLs: FamilyURLs{Any: up.URL}},
+	)
+	dialer := newTestDialer(t)
+
+	info, timing, err := getExitIPInfo(context.Background(), dialer, FamilyAny, 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", info.IPAddress)
+	assert.Equal(t, "DE", info.CountryCode)
+	assert.Equal(t, "wtfismyip", info.Provider)
+	assert.Greater(t, timing.Total, 0.0)
+
+	_, _, err = getExitIPInfo(context.Background(), dialer, FamilyIPv4, 5*time.Second)
+	assertStageError(t, err, StageUpstream, CodeUpstreamFailed)
+}
+
+func TestGetExitIPInfoFallbackOnRedirect(t *testing.T) {
+	redirect := httptest.NewServer(http.RedirectHandler("https://new.example.com/json", http.StatusMovedPermanently))
+	defer redirect.Close()
+	up := newIPInfoServer(t, http.StatusOK, `{"YourFuckingIPAddress":"192.0.2.1"}`)
+	useIPInfoProviders(t,
+		&R4bbitProvider{URLs: FamilyURLs{Any: redirect.URL}},
+		&WTFIsMyIPProvider{URLs: FamilyURLs{Any: up.URL}},
+	)
+	dialer := newTestDialer(t)
+
+	start := time.Now()
+	info, _, err := getExitIPInfo(context.Background(), dialer, FamilyAny, 5*time.Second)
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.Equal(t, "wtfismyip", info.Provider)
+
+	useIPInfoProviders(t, &R4bbitProvider{URLs: FamilyURLs{Any: redirect.URL}})
+	_, _, err = getExitIPInfo(context.Background(), dialer, FamilyAny, 5*time.Second)
+	assertStageError(t, err, StageUpstream, CodeUpstreamStatus)
+	assert.ErrorContains(t, err, "r4bbit redirected to https://new.example.com/json")
+}
+
+func TestGetExitIPInfoAllProvidersFail(t *testing.T) {
+	down := newIPInfoServer(t, http.StatusServiceUnavailable, "down")
+	invalid := newIPInfoServer(t, http.StatusOK, `{"unexpected":true}`)
+	useIPInfoProviders(t,
+		&R4bbitProvider{URLs: FamilyURLs{Any: down.URL}},
+		&R4bbitProvider{URLs: FamilyURLs{Any: invalid.URL}},
+	)
+	dialer := newTestDialer(t)
+
+	_, _, err := getExitIPInfo(context.Background(), dialer, FamilyAny, 5*time.Second)
+	assertStageError(t, err, StageDecode, CodeDecodeFailed)
+}
@@ -0,0 +1,246 @@
+package ssproxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var errMissingPort = errors.New("missing server port")
+
+// Key holds the components of a shadowsocks access key. The password is never
+// serialized so a Key can be safely sent back to clients.
+type Key struct {
+	Remark   string `json:"remark,omitempty"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Cipher   string `json:"cipher"`
+	Password string `json:"-"`
+	Plugin   string `json:"plugin,omitempty"`
+	// Prefix is the Outline connection prefix, one character between U+0000
+	// and U+00FF per byte.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// Addr returns the host:port of the shadowsocks server.
+func (k Key) Addr() string {
+	return net.JoinHostPort(k.Host, strconv.Itoa(k.Port))
+}
+
+// URL returns the key in canonical SIP002 form. The user info is base64url
+// encoded except for 2022 edition ciphers, which require it percent-encoded.
+func (k Key) URL() string {
+	userInfo := base64.RawURLEncoding.EncodeToString([]byte(k.Cipher + ":" + k.Password))
+	if isSIP022Cipher(k.Cipher) {
+		userInfo = url.PathEscape(k.Cipher) + ":" + url.PathEscape(k.Password)
+	}
+
+	u := &url.URL{Scheme: "ss", Host: k.Addr(), Fragment: k.Remark}
+	query := url.Values{}
+	if k.Plugin != "" {
+		query.Set("plugin", k.Plugin)
+	}
+	if k.Prefix != "" {
+		query.Set("prefix", k.Prefix)
+	}
+	if len(query) > 0 {
+		u.Path = "/"
+		u.RawQuery = query.Encode()
+	}
+	return strings.Replace(u.String(), "ss://", "ss://"+userInfo+"@", 1)
+}
+
+// validate checks the fields every key needs regardless of how it was given.
+func (k Key) validate() error {
+	if k.Host == "" {
+		return errors.New("missing server host")
+	}
+	if k.Port < 1 || k.Port > 65535 {
+		return fmt.Errorf("invalid server port %d", k.Port)
+	}
+	if k.Cipher == "" {
+		return errors.New("missing encryption method")
+	}
+	if _, err := prefixBytes(k.Prefix); err != nil {
+		return err
+	}
+	return nil
+}
+
+// KeyConfig describes a key with the field names used by shadowsocks-libev's
+// config.json and by the JSON form of Outline dynamic access keys.
+type KeyConfig struct {
+	Server     string      `json:"server"`
+	ServerPort json.Number `json:"server_port"`
+	Method     string      `json:"method"`
+	Password   string      `json:"password"`
+	Plugin     string      `json:"plugin,omitempty"`
+	PluginOpts string      `json:"plugin_opts,omitempty"`
+	Remarks    string      `json:"remarks,omitempty"`
+	Prefix     string      `json:"prefix,omitempty"`
+}
+
+// Key validates the config and converts it to a Key.
+func (c KeyConfig) Key() (Key, error) {
+	port, err := parsePort(c.ServerPort.String())
+	if err != nil {
+		return Key{}, err
+	}
+	key := Key{
+		Remark:   c.Remarks,
+		Host:     strings.TrimSuffix(strings.TrimPrefix(c.Server, "["), "]"),
+		Port:     port,
+		Cipher:   c.Method,
+		Password: c.Password,
+		Plugin:   c.Plugin,
+		Prefix:   c.Prefix,
+	}
+	if c.Plugin != "" && c.PluginOpts != "" {
+		key.Plugin += ";" + c.PluginOpts
+	}
+	if err := key.validate(); err != nil {
+		return Key{}, err
+	}
+	return key, nil
+}
+
+// decodeUserInfo returns the method and password held in the userinfo of a
+// SIP002 address. SIP002 allows either a base64 (standard or URL-safe, with or
+// without padding) encoding of "method:password" or, for AEAD ciphers, the
+// percent-encoded plain form. Since ':' is not part of either base64 alphabet
+// its presence is enough to tell both apart.
+func decodeUserInfo(userInfo string) (cipher, password string, err error) {
+	if !strings.Contains(userInfo, ":") {
+		decoded, err := base64DecodeStripped(userInfo)
+		if err != nil {
+			return "", "", fmt.Errorf("unable to decode user info: %w", err)
+		}
+		cipher, password, found := strings.Cut(decoded, ":")
+		if !found {
+			return "", "", errors.New("user info does not contain a method and a password")
+		}
+		return cipher, password, nil
+	}
+
+	cipher, password, _ = strings.Cut(userInfo, ":")
+	if cipher, err = url.PathUnescape(cipher); err != nil {
+		return "", "", err
+	}
+	if password, err = url.PathUnescape(password); err != nil {
+		return "", "", err
+	}
+	return cipher, password, nil
+}
+
+func base64DecodeStripped(s string) (string, error) {
+	s = strings.TrimRight(s, "=")
+	decoded, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		decoded, err = base64.RawURLEncoding.DecodeString(s)
+	}
+	return string(decoded), err
+}
+
+// parsePort validates a server port given as a string.
+func parsePort(port string) (int, error) {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return 0, fmt.Errorf("invalid server port %q", port)
+	}
+	return p, nil
+}
+
+// splitHostPort splits a server address into its host and a validated port.
+func splitHostPort(addr string) (string, int, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	p, err := parsePort(port)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, p, nil
+}
+
+func parseURL(s string) (Key, error) {
+	if !strings.HasPrefix(s, "ss://") {
+		return Key{}, fmt.Errorf("address %s does not seem to be a shadowsocks SIP002 address", s)
+	}
+	rest, fragment, _ := strings.Cut(strings.TrimPrefix(s, "ss://"), "#")
+	remark, err := url.PathUnescape(fragment)
+	if err != nil {
+		remark = fragment
+	}
+
+	// The password may contain '@' or '/' when it is not base64 encoded, so the
+	// userinfo ends at the last '@' before the query string.
+	beforeQuery, _, _ := strings.Cut(rest, "?")
+	at := strings.LastIndex(beforeQuery, "@")
+	if at < 0 {
+		key, err := parseLegacyURL(beforeQuery)
+		if err != nil {
+			return Key{}, fmt.Errorf("address %s does not seem to be a shadowsocks SIP002 or legacy address: %w", s, err)
+		}
+		key.Remark = remark
+		return key, nil
+	}
+
+	key := Key{Remark: remark}
+	key.Cipher, key.Password, err = decodeUserInfo(rest[:at])
+	if err != nil {
+		return Key{}, err
+	}
+
+	u, err := url.Parse("ss://" + rest[at+1:])
+	if err != nil {
+		return Key{}, err
+	}
+	if u.Port() == "" {
+		return Key{}, fmt.Errorf("address %s: %w", s, errMissingPort)
+	}
+	key.Host, key.Port, err = splitHostPort(u.Host)
+	if err != nil {
+		return Key{}, err
+	}
+	key.Plugin = u.Query().Get("plugin")
+	key.Prefix = u.Query().Get("prefix")
+
+	if err := key.validate(); err != nil {
+		return Key{}, err
+	}
+	return key, nil
+}
+
+// parseLegacyURL parses the body of a pre-SIP002 address, where the whole
+// "method:password@host:port" is base64 encoded and nothing is percent-encoded.
+func parseLegacyURL(encoded string) (Key, error) {
+	decoded, err := base64DecodeStripped(encoded)
+	if err != nil {
+		return Key{}, err
+	}
+
+	at := strings.LastIndex(decoded, "@")
+	if at < 0 {
+		return Key{}, errors.New("missing server address")
+	}
+	cipher, password, found := strings.Cut(decoded[:at], ":")
+	if !found {
+		return Key{}, errors.New("missing method or password")
+	}
+
+	host, port, err := splitHostPort(decoded[at+1:])
+	if err != nil {
+		return Key{}, err
+	}
+	key := Key{Host: host, Port: port, Cipher: cipher, Password: password}
+	if err := key.validate(); err != nil {
+		return Key{}, err
+	}
+	return key, nil
+}
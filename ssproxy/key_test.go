@@ -0,0 +1,162 @@
+package ssproxy
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUrl(t *testing.T) {
+	address := "ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpwYXNzd29yZA@localhost:6276/?outline=1"
+	key, err := parseURL(address)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:6276", key.Addr())
+	assert.Equal(t, "chacha20-ietf-poly1305", key.Cipher)
+	assert.Equal(t, "password", key.Password)
+}
+
+func TestParseBadURL(t *testing.T) {
+	address := "aaa"
+	_, err := parseURL(address)
+	assert.Error(t, err)
+}
+
+func TestParseURLWithSpecialCharactersInPassword(t *testing.T) {
+	address := "ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTp0Lm1lL091dGxpbmVWcG5PZmZpY2lhbA==@www.outline.network.lki33eqtfhgp5p4qrtdkyv5cqjp3r6zqhxacluztckcvj7qdorl4ulpt9jf6u29.fr8678825324247b8176d59f83c30bd94d23d2e3ac5cd4a743bkwqeikvdyufr.cyou:8080#t.me%2FOutlineVpnOfficial%20%7C%20%281875%29%20IN"
+	key, err := parseURL(address)
+	require.NoError(t, err)
+	assert.Equal(t, "www.outline.network.lki33eqtfhgp5p4qrtdkyv5cqjp3r6zqhxacluztckcvj7qdorl4ulpt9jf6u29.fr8678825324247b8176d59f83c30bd94d23d2e3ac5cd4a743bkwqeikvdyufr.cyou:8080", key.Addr())
+	assert.Equal(t, "chacha20-ietf-poly1305", key.Cipher)
+	assert.Equal(t, "t.me/OutlineVpnOfficial", key.Password)
+}
+
+func TestParseURLNoBase64(t *testing.T) {
+	address := "ss://chacha20-ietf-poly1305:password@localhost:6276/?outline=1"
+	key, err := parseURL(address)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:6276", key.Addr())
+	assert.Equal(t, "chacha20-ietf-poly1305", key.Cipher)
+	assert.Equal(t, "password", key.Password)
+}
+
+func TestParseURLNoBase64WithSpecialCharactersInPassword(t *testing.T) {
+	address := "ss://aes-256-gcm:p%40ss:w/rd@localhost:6276/?outline=1#remark"
+	key, err := parseURL(address)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:6276", key.Addr())
+	assert.Equal(t, "aes-256-gcm", key.Cipher)
+	assert.Equal(t, "p@ss:w/rd", key.Password)
+
+	address = "ss://aes-256-gcm:p@ss@localhost:6276"
+	key, err = parseURL(address)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:6276", key.Addr())
+	assert.Equal(t, "p@ss", key.Password)
+}
+
+func TestParseURLSafeBase64(t *testing.T) {
+	address := "ss://YWVzLTI1Ni1nY206cD4-P3Nz@localhost:6276"
+	key, err := parseURL(address)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:6276", key.Addr())
+	assert.Equal(t, "aes-256-gcm", key.Cipher)
+	assert.Equal(t, "p>>?ss", key.Password)
+}
+
+func TestParseURLBase64WithSpecialCharactersInPassword(t *testing.T) {
+	address := "ss://YWVzLTEyOC1nY206YUBiOmMvZD8=@localhost:6276/?plugin=obfs-local"
+	key, err := parseURL(address)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:6276", key.Addr())
+	assert.Equal(t, "aes-128-gcm", key.Cipher)
+	assert.Equal(t, "a@b:c/d?", key.Password)
+}
+
+func TestParseURLMissingPort(t *testing.T) {
+	address := "ss://chacha20-ietf-poly1305:password@localhost"
+	_, err := parseURL(address)
+	assert.Error(t, err)
+}
+
+func TestParseLegacyURL(t *testing.T) {
+	address := "ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpwQHNzOndvcmRAbG9jYWxob3N0OjYyNzY=#tag"
+	key, err := parseURL(address)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:6276", key.Addr())
+	assert.Equal(t, "chacha20-ietf-poly1305", key.Cipher)
+	assert.Equal(t, "p@ss:word", key.Password)
+}
+
+func TestParseLegacyURLWithIPv6Host(t *testing.T) {
+	address := "ss://YWVzLTI1Ni1nY206cGFzc3dvcmRAWzo6MV06ODM4OA"
+	key, err := parseURL(address)
+	require.NoError(t, err)
+	assert.Equal(t, "[::1]:8388", key.Addr())
+	assert.Equal(t, "aes-256-gcm", key.Cipher)
+	assert.Equal(t, "password", key.Password)
+}
+
+func TestParseLegacyURLMissingServer(t *testing.T) {
+	address := "ss://YWVzLTI1Ni1nY206cGFzc3dvcmQ=#tag"
+	_, err := parseURL(address)
+	assert.Error(t, err)
+}
+
+func TestParseURLComponents(t *testing.T) {
+	address := "ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpwYXNzd29yZA@[2001:db8::1]:8388/?plugin=obfs-local%3Bobfs%3Dhttp#t.me%2FOutlineVpnOfficial%20%7C%20IN"
+	key, err := parseURL(address)
+	require.NoError(t, err)
+	assert.Equal(t, "t.me/OutlineVpnOfficial | IN", key.Remark)
+	assert.Equal(t, "2001:db8::1", key.Host)
+	assert.Equal(t, 8388, key.Port)
+	assert.Equal(t, "[2001:db8::1]:8388", key.Addr())
+	assert.Equal(t, "chacha20-ietf-poly1305", key.Cipher)
+	assert.Equal(t, "obfs-local;obfs=http", key.Plugin)
+}
+
+func TestParseURLInvalidPort(t *testing.T) {
+	address := "ss://chacha20-ietf-poly1305:password@localhost:70000"
+	_, err := parseURL(address)
+	assert.Error(t, err)
+}
+
+func TestKeyJSONDoesNotContainPassword(t *testing.T) {
+	key := Key{Host: "localhost", Port: 6276, Cipher: "aes-256-gcm", Password: "secret"}
+	b, err := json.Marshal(key)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "secret")
+	assert.JSONEq(t, `{"host":"localhost","port":6276,"cipher":"aes-256-gcm"}`, string(b))
+}
+
+func TestKeyConfig(t *testing.T) {
+	config := KeyConfig{
+		Server:     "[2001:db8::1]",
+		ServerPort: "8388",
+		Method:     "aes-256-gcm",
+		Password:   "secret",
+		Plugin:     "obfs-local",
+		PluginOpts: "obfs=http",
+	}
+	key, err := config.Key()
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:8388", key.Addr())
+	assert.Equal(t, "aes-256-gcm", key.Cipher)
+	assert.Equal(t, "secret", key.Password)
+	assert.Equal(t, "obfs-local;obfs=http", key.Plugin)
+}
+
+func TestKeyConfigInvalid(t *testing.T) {
+	for name, config := range map[string]KeyConfig{
+		"missing server": {ServerPort: "8388", Method: "aes-256-gcm"},
+		"missing port":   {Server: "localhost", Method: "aes-256-gcm"},
+		"invalid port":   {Server: "localhost", ServerPort: "99999", Method: "aes-256-gcm"},
+		"missing method": {Server: "localhost", ServerPort: "8388"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := config.Key()
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package ssproxy
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// LabelCheck compares the country claimed in the remark of a key with the
+// country of its exit IP, both as ISO 3166-1 alpha-2 codes.
+type LabelCheck struct {
+	Claimed string `json:"claimed_country"`
+	Exit    string `json:"exit_country"`
+}
+
+// maxCountryNameWords is the number of words of the longest country name.
+const maxCountryNameWords = 7
+
+// countryAliases are the codes used in remarks that are not ISO codes.
+var countryAliases = map[string]string{"UK": "GB"}
+
+// placeNames are places named after another country, whose words are never
+// read as that country, like New Jersey for Jersey.
+var placeNames = map[string]bool{
+	"new jersey":      true,
+	"jersey city":     true,
+	"new mexico":      true,
+	"new england":     true,
+	"new south wales": true,
+}
+
+// bracketedCode matches a code between brackets, like "[DE]" or "(DE)".
+var bracketedCode = regexp.MustCompile(`[\[(【（{]\s*([A-Za-z]{2})\s*[\])】）}]`)
+
+// countryNameIndex maps the normalized country names to their codes.
+var countryNameIndex = func() map[string]string {
+	index := map[string]string{}
+	for code, names := range countryNames {
+		for _, name := range names {
+			index[normalizeCountryName(name)] = code
+		}
+	}
+	return index
+}()
+
+// RemarkCountry returns the ISO code of the country claimed in a remark, from
+// a flag emoji, an English country name or an ISO code, in that order of
+// preference. It returns an empty string when the remark claims no country.
+func RemarkCountry(remark string) string {
+	if code := flagCountry(remark); code != "" {
+		return code
+	}
+	if code := nameCountry(remark); code != "" {
+		return code
+	}
+	return codeCountry(remark)
+}
+
+// flagCountry returns the country of the first flag emoji of s. Flags are
+// pairs of regional indicators, or tag sequences for the subdivisions of the
+// United Kingdom.
+func flagCountry(s string) string {
+	runes := []rune(s)
+	for i, r := range runes {
+		if isRegionalIndicator(r) && i+1 < len(runes) && isRegionalIndicator(runes[i+1]) {
+			code := string([]rune{'A' + r - 0x1F1E6, 'A' + runes[i+1] - 0x1F1E6})
+			if _, ok := countryNames[code]; ok {
+				return code
+			}
+		}
+		if r == 0x1F3F4 && i+2 < len(runes) && runes[i+1] == 0xE0067 && runes[i+2] == 0xE0062 {
+			return "GB"
+		}
+	}
+	return ""
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// nameCountry returns the country whose English name appears first in s as
+// whole words, preferring the longest name when several start at the same word
+// and skipping the places named after another country when they are longer.
+func nameCountry(s string) string {
+	words := strings.Fields(normalizeCountryName(s))
+	for start := 0; start < len(words); start++ {
+		skip := 0
+		for end := min(len(words), start+maxCountryNameWords); end > start; end-- {
+			name := strings.Join(words[start:end], " ")
+			if code, ok := countryNameIndex[name]; ok {
+				return code
+			}
+			if placeNames[name] {
+				skip = end - start - 1
+				break
+			}
+		}
+		start += skip
+	}
+	return ""
+}
+
+// codeCountry returns the country of an upper case ISO code leading s or
+// between brackets, so that "US-01" and "Fast [US]" are read as the United
+// States but not "us", "V2ray_US" or "join TG", where TG means Telegram.
+func codeCountry(s string) string {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	if len(fields) > 0 {
+		if code := countryCode(fields[0]); code != "" {
+			return code
+		}
+	}
+	for _, match := range bracketedCode.FindAllStringSubmatch(s, -1) {
+		if code := countryCode(match[1]); code != "" {
+			return code
+		}
+	}
+	return ""
+}
+
+// countryCode returns the country of an upper case ISO code or alias.
+func countryCode(field string) string {
+	if alias, ok := countryAliases[field]; ok {
+		return alias
+	}
+	if _, ok := countryNames[field]; ok && len(field) == 2 && strings.ToUpper(field) == field {
+		return field
+	}
+	return ""
+}
+
+// normalizeCountryName lower cases s and replaces everything but letters with
+// spaces.
+func normalizeCountryName(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	}), " ")
+}
+
+// checkLabel compares the country claimed in the remark with the exit
+// country. It returns nil when either is unknown.
+func checkLabel(remark, exitCountryCode string) (*LabelCheck, *bool) {
+	claimed := RemarkCountry(remark)
+	exit := strings.ToUpper(exitCountryCode)
+	if claimed == "" || exit == "" {
+		return nil, nil
+	}
+	mismatch := claimed != exit
+	return &LabelCheck{Claimed: claimed, Exit: exit}, &mismatch
+}
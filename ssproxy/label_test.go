@@ -0,0 +1,62 @@
+package ssproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemarkCountry(t *testing.T) {
+	for remark, expected := range map[string]string{
+		"🇺🇸 US-01":                  "US",
+		"Server 🇩🇪 | US relay":      "DE",
+		"🏴󠁧󠁢󠁳󠁣󠁴󠁿 Edinburgh":         "GB",
+		"Germany - Frankfurt":       "DE",
+		"fast united states node":   "US",
+		"Papua New Guinea":          "PG",
+		"Guinea-Bissau 2":           "GW",
+		"Côte d'Ivoire":             "CI",
+		"Turkey #3":                 "TR",
+		"JP-Tokyo-05":               "JP",
+		"UK London":                 "GB",
+		"@V2ray_NL":                 "",
+		"us west":                   "",
+		"free server":               "",
+		"":                          "",
+		"Netherlands 🇫🇷 flag first": "FR",
+		"Fast [DE] server":          "DE",
+		"Node (JP) 3":               "JP",
+		"New Zealand":               "NZ",
+		"New Jersey 01":             "",
+		"Jersey City relay":         "",
+		"New South Wales":           "",
+		"New Jersey - Jersey":       "JE",
+		"Free node, join TG":        "",
+		"Server 3 US":               "",
+		"Fast [tg] server":          "",
+	} {
+		assert.Equal(t, expected, RemarkCountry(remark), remark)
+	}
+}
+
+func TestCheckLabel(t *testing.T) {
+	label, mismatch := checkLabel("🇺🇸 US-01", "de")
+	require.NotNil(t, label)
+	assert.Equal(t, LabelCheck{Claimed: "US", Exit: "DE"}, *label)
+	require.NotNil(t, mismatch)
+	assert.True(t, *mismatch)
+
+	label, mismatch = checkLabel("Germany", "DE")
+	require.NotNil(t, label)
+	require.NotNil(t, mismatch)
+	assert.False(t, *mismatch)
+
+	label, mismatch = checkLabel("free server", "DE")
+	assert.Nil(t, label)
+	assert.Nil(t, mismatch)
+
+	label, mismatch = checkLabel("Germany", "")
+	assert.Nil(t, label)
+	assert.Nil(t, mismatch)
+}
@@ -0,0 +1,147 @@
+package ssproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Warning codes reported by LintAddress and LintKey.
+const (
+	WarningDeprecatedCipher = "deprecated_cipher"
+	WarningInsecureCipher   = "insecure_cipher"
+	WarningPrivateHost      = "private_host"
+	WarningMissingPort      = "missing_port"
+	WarningUnknownPlugin    = "unknown_plugin"
+)
+
+// deprecatedStreamCiphers are the stream ciphers removed from current
+// shadowsocks implementations because they have no integrity protection.
+var deprecatedStreamCiphers = map[string]bool{
+	"rc4": true, "rc4-md5": true, "rc4-md5-6": true,
+	"aes-128-cfb": true, "aes-192-cfb": true, "aes-256-cfb": true,
+	"aes-128-cfb1": true, "aes-192-cfb1": true, "aes-256-cfb1": true,
+	"aes-128-cfb8": true, "aes-192-cfb8": true, "aes-256-cfb8": true,
+	"aes-128-ctr": true, "aes-192-ctr": true, "aes-256-ctr": true,
+	"aes-128-ofb": true, "aes-192-ofb": true, "aes-256-ofb": true,
+	"camellia-128-cfb": true, "camellia-192-cfb": true, "camellia-256-cfb": true,
+	"bf-cfb": true, "cast5-cfb": true, "des-cfb": true, "idea-cfb": true, "rc2-cfb": true, "seed-cfb": true,
+	"salsa20": true, "chacha20": true, "chacha20-ietf": true, "xchacha20": true,
+}
+
+// insecureCiphers are the methods that do not encrypt the traffic at all.
+var insecureCiphers = map[string]bool{
+	"none": true, "plain": true, "table": true, "dummy": true,
+}
+
+// KeyWarning is a problem found in a key that does not make it unusable.
+type KeyWarning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// KeyReport is the result of validating a key without connecting to it.
+type KeyReport struct {
+	// Valid is true when the key parses and ShadowTest supports its cipher.
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+	// Canonical is the key in SIP002 form, including its password.
+	Canonical string       `json:"canonical,omitempty"`
+	Key       *Key         `json:"key,omitempty"`
+	Warnings  []KeyWarning `json:"warnings"`
+}
+
+func (r *KeyReport) warn(code, format string, args ...any) {
+	r.Warnings = append(r.Warnings, KeyWarning{Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// LintAddress parses and validates an address without ever dialing the server.
+func LintAddress(address string) KeyReport {
+	address = strings.TrimSpace(strings.NewReplacer("\n", "", "\r", "").Replace(address))
+	if isDynamicKey(address) {
+		return KeyReport{
+			Error:    "dynamic access keys have to be resolved before they can be validated",
+			Warnings: []KeyWarning{},
+		}
+	}
+
+	key, err := parseURL(address)
+	if err != nil {
+		report := KeyReport{Error: err.Error(), Warnings: []KeyWarning{}}
+		if errors.Is(err, errMissingPort) {
+			report.warn(WarningMissingPort, "the address does not have a server port")
+		}
+		return report
+	}
+	return LintKey(key)
+}
+
+// LintKey validates a parsed key without ever dialing the server.
+func LintKey(key Key) KeyReport {
+	report := KeyReport{Warnings: []KeyWarning{}}
+	if err := key.validate(); err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Key = &key
+	report.Canonical = key.URL()
+
+	cipher := strings.ToLower(key.Cipher)
+	if deprecatedStreamCiphers[cipher] {
+		report.warn(WarningDeprecatedCipher, "%s is a deprecated stream cipher", key.Cipher)
+	}
+	if insecureCiphers[cipher] {
+		report.warn(WarningInsecureCipher, "%s does not encrypt the traffic", key.Cipher)
+	}
+	if isPrivateHost(key.Host) {
+		report.warn(WarningPrivateHost, "%s is a private or loopback address", key.Host)
+	}
+	if key.Plugin != "" && !isKnownPlugin(key) {
+		report.warn(WarningUnknownPlugin, "plugin %s is not supported", key.Plugin)
+	}
+
+	if _, err := pickCipher(key); err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Valid = true
+	return report
+}
+
+// isPrivateHost reports whether host is a loopback, private, link-local or
+// unspecified address. Hostnames are not resolved.
+func isPrivateHost(host string) bool {
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// isKnownPlugin reports whether the plugin of the key is implemented natively
+// or available as an external plugin.
+func isKnownPlugin(key Key) bool {
+	_, err := pluginWrapper(key)
+	if err == nil {
+		return true
+	}
+	if !errors.Is(err, errUnsupportedPlugin) {
+		return false
+	}
+
+	plugin, err := parsePlugin(key.Plugin)
+	if err != nil {
+		return false
+	}
+	dir := getExternalPluginDir()
+	if dir == "" {
+		return false
+	}
+	_, err = externalPluginPath(dir, plugin.Name)
+	return err == nil
+}
@@ -0,0 +1,78 @@
+package ssproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func warningCodes(report KeyReport) []string {
+	codes := []string{}
+	for _, warning := range report.Warnings {
+		codes = append(codes, warning.Code)
+	}
+	return codes
+}
+
+func TestLintAddress(t *testing.T) {
+	report := LintAddress("ss://chacha20-ietf-poly1305:password@example.com:8388/?plugin=obfs-local%3Bobfs%3Dhttp#My%20Server")
+	assert.True(t, report.Valid)
+	assert.Empty(t, report.Error)
+	assert.Empty(t, report.Warnings)
+	require.NotNil(t, report.Key)
+	assert.Equal(t, "example.com", report.Key.Host)
+	assert.Equal(t, 8388, report.Key.Port)
+	assert.Equal(t, "My Server", report.Key.Remark)
+	assert.Equal(t, "ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpwYXNzd29yZA@example.com:8388/?plugin=obfs-local%3Bobfs%3Dhttp#My%20Server", report.Canonical)
+}
+
+func TestLintAddressCanonicalRoundTrip(t *testing.T) {
+	for _, address := range []string{
+		"ss://YWVzLTEyOC1nY206YUBiOmMvZD8=@[2001:db8::1]:6276/?plugin=obfs-local&prefix=%16%03%01%00%C2%A8%01%01#t.me%2Fchannel",
+		"ss://2022-blake3-aes-128-gcm:MTIzNDU2Nzg5MDEyMzQ1Ng%3D%3D@example.com:8388",
+		"ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpwQHNzOndvcmRAbG9jYWxob3N0OjYyNzY=#legacy",
+	} {
+		report := LintAddress(address)
+		require.NotEmpty(t, report.Canonical, address)
+		key, err := parseURL(report.Canonical)
+		require.NoError(t, err, report.Canonical)
+		assert.Equal(t, *report.Key, key)
+		assert.Equal(t, report.Key.Password, key.Password)
+	}
+}
+
+func TestLintAddressWarnings(t *testing.T) {
+	for name, test := range map[string]struct {
+		address string
+		valid   bool
+		codes   []string
+	}{
+		"stream cipher":  {"ss://aes-256-cfb:password@example.com:8388", false, []string{WarningDeprecatedCipher}},
+		"none method":    {"ss://none:password@example.com:8388", false, []string{WarningInsecureCipher}},
+		"loopback host":  {"ss://aes-256-gcm:password@127.0.0.1:8388", true, []string{WarningPrivateHost}},
+		"private host":   {"ss://aes-256-gcm:password@192.168.1.10:8388", true, []string{WarningPrivateHost}},
+		"localhost":      {"ss://aes-256-gcm:password@localhost:8388", true, []string{WarningPrivateHost}},
+		"missing port":   {"ss://aes-256-gcm:password@example.com", false, []string{WarningMissingPort}},
+		"unknown plugin": {"ss://aes-256-gcm:password@example.com:8388/?plugin=v2ray-plugin%3Btls", true, []string{WarningUnknownPlugin}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			report := LintAddress(test.address)
+			assert.Equal(t, test.valid, report.Valid, report.Error)
+			assert.Equal(t, test.codes, warningCodes(report))
+		})
+	}
+}
+
+func TestLintAddressInvalid(t *testing.T) {
+	for _, address := range []string{
+		"aaa",
+		"ss://unknown-cipher:password@example.com:8388",
+		"ss://2022-blake3-aes-128-gcm:short@example.com:8388",
+		"ssconf://example.com/key",
+	} {
+		report := LintAddress(address)
+		assert.False(t, report.Valid, address)
+		assert.NotEmpty(t, report.Error, address)
+	}
+}
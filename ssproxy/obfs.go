@@ -0,0 +1,287 @@
+package ssproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+In-process implementation of the client side of simple-obfs
+(https://github.com/shadowsocks/simple-obfs), so keys using the obfs-local
+plugin can be tested without spawning the plugin binary. Both modes wrap the
+raw connection to the server, below the shadowsocks stream.
+*/
+
+const (
+	tlsRecordChangeCipherSpec = 0x14
+	tlsRecordAlert            = 0x15
+	tlsRecordHandshake        = 0x16
+	tlsRecordApplicationData  = 0x17
+	tlsRecordHeaderLen        = 5
+	tlsMaxRecordPayload       = 16 * 1024
+	obfsDefaultHTTPPort       = 80
+	obfsTLSSessionIDLen       = 32
+	obfsTLSRandomLen          = 28
+	obfsHTTPMaxResponseHeader = 16 * 1024
+)
+
+// obfsTLSCipherSuites and obfsTLSSignatureAlgorithms are the values sent by
+// simple-obfs in its ClientHello.
+var (
+	obfsTLSCipherSuites = []byte{
+		0xc0, 0x2c, 0xc0, 0x30, 0x00, 0x9f, 0xcc, 0xa9, 0xcc, 0xa8, 0xcc, 0xaa, 0xc0, 0x2b, 0xc0, 0x2f,
+		0x00, 0x9e, 0xc0, 0x24, 0xc0, 0x28, 0x00, 0x6b, 0xc0, 0x23, 0xc0, 0x27, 0x00, 0x67, 0xc0, 0x0a,
+		0xc0, 0x14, 0x00, 0x39, 0xc0, 0x09, 0xc0, 0x13, 0x00, 0x33, 0x00, 0x9d, 0x00, 0x9c, 0x00, 0x3d,
+		0x00, 0x3c, 0x00, 0x35, 0x00, 0x2f, 0x00, 0xff,
+	}
+	obfsTLSSignatureAlgorithms = []byte{
+		0x06, 0x01, 0x06, 0x02, 0x06, 0x03, 0x05, 0x01, 0x05, 0x02, 0x05, 0x03, 0x04, 0x01, 0x04, 0x02,
+		0x04, 0x03, 0x03, 0x01, 0x03, 0x02, 0x03, 0x03, 0x02, 0x01, 0x02, 0x02, 0x02, 0x03,
+	}
+)
+
+// obfsWrapper returns the simple-obfs wrapper configured by the plugin options.
+func obfsWrapper(key Key, plugin pluginConfig) (func(net.Conn) net.Conn, error) {
+	host := plugin.Options["obfs-host"]
+	if host == "" {
+		host = key.Host
+	}
+
+	switch plugin.Options["obfs"] {
+	case "http":
+		if key.Port != obfsDefaultHTTPPort {
+			host = net.JoinHostPort(host, strconv.Itoa(key.Port))
+		}
+		uri := plugin.Options["obfs-uri"]
+		if uri == "" {
+			uri = "/"
+		}
+		return func(c net.Conn) net.Conn {
+			return &obfsHTTPConn{Conn: c, host: host, uri: uri}
+		}, nil
+	case "tls":
+		return func(c net.Conn) net.Conn {
+			return &obfsTLSConn{Conn: c, host: host}
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported obfs mode %q", plugin.Options["obfs"])
+	}
+}
+
+// obfsHTTPConn sends the first payload in the body of a fake websocket upgrade
+// request and strips the HTTP response headers from the first read.
+type obfsHTTPConn struct {
+	net.Conn
+	host string
+	uri  string
+
+	writeMu    sync.Mutex
+	wroteFirst bool
+
+	reader *bufio.Reader
+}
+
+func (c *obfsHTTPConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.wroteFirst {
+		return c.Conn.Write(b)
+	}
+
+	websocketKey := make([]byte, 16)
+	if _, err := rand.Read(websocketKey); err != nil {
+		return 0, err
+	}
+	major, err := rand.Int(rand.Reader, big.NewInt(51))
+	if err != nil {
+		return 0, err
+	}
+	minor, err := rand.Int(rand.Reader, big.NewInt(2))
+	if err != nil {
+		return 0, err
+	}
+
+	var request bytes.Buffer
+	_, _ = fmt.Fprintf(&request, "GET %s HTTP/1.1\r\n", c.uri)
+	_, _ = fmt.Fprintf(&request, "Host: %s\r\n", c.host)
+	_, _ = fmt.Fprintf(&request, "User-Agent: curl/7.%d.%d\r\n", major.Int64(), minor.Int64())
+	request.WriteString("Upgrade: websocket\r\n")
+	request.WriteString("Connection: Upgrade\r\n")
+	_, _ = fmt.Fprintf(&request, "Sec-WebSocket-Key: %s\r\n", base64.StdEncoding.EncodeToString(websocketKey))
+	_, _ = fmt.Fprintf(&request, "Content-Length: %d\r\n\r\n", len(b))
+	request.Write(b)
+
+	if _, err := c.Conn.Write(request.Bytes()); err != nil {
+		return 0, err
+	}
+	c.wroteFirst = true
+	return len(b), nil
+}
+
+func (c *obfsHTTPConn) Read(b []byte) (int, error) {
+	if c.reader == nil {
+		c.reader = bufio.NewReader(io.LimitReader(c.Conn, obfsHTTPMaxResponseHeader))
+		response, err := http.ReadResponse(c.reader, nil)
+		if err != nil {
+			return 0, fmt.Errorf("invalid obfs http response: %w", err)
+		}
+		if response.StatusCode != http.StatusSwitchingProtocols {
+			return 0, fmt.Errorf("unexpected obfs http response status %s", response.Status)
+		}
+	}
+	if c.reader.Buffered() > 0 {
+		return c.reader.Read(b[:min(len(b), c.reader.Buffered())])
+	}
+	return c.Conn.Read(b)
+}
+
+// obfsTLSConn sends the first payload as the session ticket of a fake TLS
+// ClientHello and exchanges the rest as TLS application data records.
+type obfsTLSConn struct {
+	net.Conn
+	host string
+
+	writeMu    sync.Mutex
+	wroteFirst bool
+
+	readBuf []byte
+	// sawChangeCipherSpec is set once the ChangeCipherSpec of the server was
+	// read, and readFirst once the handshake record following it was.
+	sawChangeCipherSpec bool
+	readFirst           bool
+}
+
+func (c *obfsTLSConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if !c.wroteFirst {
+		hello, err := obfsTLSClientHello(c.host, b)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := c.Conn.Write(hello); err != nil {
+			return 0, err
+		}
+		c.wroteFirst = true
+		return len(b), nil
+	}
+
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), tlsMaxRecordPayload)
+		record := make([]byte, 0, tlsRecordHeaderLen+n)
+		record = append(record, tlsRecordApplicationData, 0x03, 0x03)
+		record = binary.BigEndian.AppendUint16(record, uint16(n))
+		record = append(record, b[:n]...)
+		if _, err := c.Conn.Write(record); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Read skips the ServerHello and the ChangeCipherSpec and returns the payload
+// of the handshake record that follows them, where simple-obfs servers send
+// their first data, and then that of application data records. An alert
+// record, sent by servers that are not simple-obfs, is an error.
+func (c *obfsTLSConn) Read(b []byte) (int, error) {
+	for len(c.readBuf) == 0 {
+		header := make([]byte, tlsRecordHeaderLen)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return 0, err
+		}
+		record := make([]byte, binary.BigEndian.Uint16(header[3:]))
+		if _, err := io.ReadFull(c.Conn, record); err != nil {
+			return 0, err
+		}
+		switch {
+		case header[0] == tlsRecordAlert:
+			if len(record) < 2 {
+				return 0, errors.New("obfs tls server sent an invalid alert")
+			}
+			return 0, fmt.Errorf("obfs tls server sent alert %d (level %d)", record[1], record[0])
+		case header[0] == tlsRecordChangeCipherSpec:
+			c.sawChangeCipherSpec = true
+		case header[0] == tlsRecordHandshake && c.sawChangeCipherSpec && !c.readFirst:
+			c.readBuf = record
+			c.readFirst = true
+		case header[0] == tlsRecordApplicationData:
+			c.readBuf = record
+		}
+	}
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// obfsTLSClientHello builds the ClientHello sent by simple-obfs, carrying the
+// payload in the session ticket extension.
+func obfsTLSClientHello(host string, payload []byte) ([]byte, error) {
+	if len(payload) > tlsMaxRecordPayload {
+		return nil, errors.New("obfs tls first payload is too big")
+	}
+
+	var extensions []byte
+	// session ticket
+	extensions = binary.BigEndian.AppendUint16(extensions, 0x0023)
+	extensions = binary.BigEndian.AppendUint16(extensions, uint16(len(payload)))
+	extensions = append(extensions, payload...)
+	// server name
+	extensions = binary.BigEndian.AppendUint16(extensions, 0x0000)
+	extensions = binary.BigEndian.AppendUint16(extensions, uint16(len(host)+5))
+	extensions = binary.BigEndian.AppendUint16(extensions, uint16(len(host)+3))
+	extensions = append(extensions, 0x00)
+	extensions = binary.BigEndian.AppendUint16(extensions, uint16(len(host)))
+	extensions = append(extensions, host...)
+	// ec point formats
+	extensions = append(extensions, 0x00, 0x0b, 0x00, 0x04, 0x03, 0x01, 0x00, 0x02)
+	// elliptic curves
+	extensions = append(extensions, 0x00, 0x0a, 0x00, 0x0a, 0x00, 0x08, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x19, 0x00, 0x18)
+	// signature algorithms
+	extensions = append(extensions, 0x00, 0x0d)
+	extensions = binary.BigEndian.AppendUint16(extensions, uint16(len(obfsTLSSignatureAlgorithms)+2))
+	extensions = binary.BigEndian.AppendUint16(extensions, uint16(len(obfsTLSSignatureAlgorithms)))
+	extensions = append(extensions, obfsTLSSignatureAlgorithms...)
+	// encrypt then mac and extended master secret
+	extensions = append(extensions, 0x00, 0x16, 0x00, 0x00, 0x00, 0x17, 0x00, 0x00)
+
+	random := make([]byte, obfsTLSRandomLen+obfsTLSSessionIDLen)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+
+	var hello []byte
+	hello = append(hello, 0x03, 0x03)
+	hello = binary.BigEndian.AppendUint32(hello, uint32(time.Now().Unix()))
+	hello = append(hello, random[:obfsTLSRandomLen]...)
+	hello = append(hello, obfsTLSSessionIDLen)
+	hello = append(hello, random[obfsTLSRandomLen:]...)
+	hello = binary.BigEndian.AppendUint16(hello, uint16(len(obfsTLSCipherSuites)))
+	hello = append(hello, obfsTLSCipherSuites...)
+	hello = append(hello, 0x01, 0x00)
+	hello = binary.BigEndian.AppendUint16(hello, uint16(len(extensions)))
+	hello = append(hello, extensions...)
+
+	record := make([]byte, 0, tlsRecordHeaderLen+4+len(hello))
+	record = append(record, tlsRecordHandshake, 0x03, 0x01)
+	record = binary.BigEndian.AppendUint16(record, uint16(len(hello)+4))
+	record = append(record, 0x01, byte(len(hello)>>16))
+	record = binary.BigEndian.AppendUint16(record, uint16(len(hello)))
+	record = append(record, hello...)
+	return record, nil
+}
@@ -0,0 +1,191 @@
+package ssproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dialObfs(t *testing.T, addr string, wrap func(net.Conn) net.Conn) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	return wrap(conn)
+}
+
+func TestObfsHTTP(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	addr := startTCPServer(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		body, _ := io.ReadAll(request.Body)
+		requests <- request
+		bodies <- string(body)
+		_, _ = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nServer: nginx/1.0\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\nhello"))
+
+		next := make([]byte, 5)
+		if _, err := io.ReadFull(reader, next); err != nil {
+			return
+		}
+		_, _ = conn.Write(next)
+	})
+
+	wrap, err := pluginWrapper(Key{Host: "localhost", Port: 8388, Plugin: "obfs-local;obfs=http;obfs-host=example.com"})
+	require.NoError(t, err)
+	conn := dialObfs(t, addr, wrap)
+
+	_, err = conn.Write([]byte("first"))
+	require.NoError(t, err)
+	request := <-requests
+	assert.Equal(t, "example.com:8388", request.Host)
+	assert.Equal(t, "/", request.URL.Path)
+	assert.Equal(t, "websocket", request.Header.Get("Upgrade"))
+	assert.NotEmpty(t, request.Header.Get("Sec-WebSocket-Key"))
+	assert.Equal(t, "first", <-bodies)
+
+	response := make([]byte, 5)
+	_, err = io.ReadFull(conn, response)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(response))
+
+	_, err = conn.Write([]byte("again"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, response)
+	require.NoError(t, err)
+	assert.Equal(t, "again", string(response))
+}
+
+func TestObfsHTTPUnexpectedResponse(t *testing.T) {
+	addr := startTCPServer(t, func(conn net.Conn) {
+		_, _ = http.ReadRequest(bufio.NewReader(conn))
+		_, _ = conn.Write([]byte("HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"))
+	})
+
+	wrap, err := pluginWrapper(Key{Host: "localhost", Port: 80, Plugin: "obfs-local;obfs=http"})
+	require.NoError(t, err)
+	conn := dialObfs(t, addr, wrap)
+
+	_, err = conn.Write([]byte("first"))
+	require.NoError(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestObfsTLSAlert(t *testing.T) {
+	addr := startTCPServer(t, func(conn net.Conn) {
+		if _, _, err := readTLSRecord(conn); err != nil {
+			return
+		}
+		// A fatal handshake_failure alert, as a real TLS server would send.
+		_, _ = conn.Write([]byte{tlsRecordAlert, 0x03, 0x03, 0x00, 0x02, 0x02, 0x28})
+		_, _ = io.Copy(io.Discard, conn)
+	})
+
+	wrap, err := pluginWrapper(Key{Host: "localhost", Port: 443, Plugin: "obfs-local;obfs=tls"})
+	require.NoError(t, err)
+	conn := dialObfs(t, addr, wrap)
+
+	_, err = conn.Write([]byte("first"))
+	require.NoError(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	assert.EqualError(t, err, "obfs tls server sent alert 40 (level 2)")
+}
+
+// readTLSRecord reads one TLS record and returns its type and payload.
+func readTLSRecord(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, tlsRecordHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	_, err := io.ReadFull(r, payload)
+	return header[0], payload, err
+}
+
+// sessionTicket extracts the session ticket extension from a ClientHello.
+func sessionTicket(t *testing.T, hello []byte) ([]byte, string) {
+	// handshake header, version, random, session id
+	offset := 4 + 2 + 32
+	offset += 1 + int(hello[offset])
+	offset += 2 + int(binary.BigEndian.Uint16(hello[offset:]))
+	offset += 1 + int(hello[offset])
+	extensionsLen := int(binary.BigEndian.Uint16(hello[offset:]))
+	offset += 2
+	require.Equal(t, len(hello), offset+extensionsLen)
+
+	var ticket []byte
+	var serverName string
+	for offset < len(hello) {
+		extensionType := binary.BigEndian.Uint16(hello[offset:])
+		extensionLen := int(binary.BigEndian.Uint16(hello[offset+2:]))
+		data := hello[offset+4 : offset+4+extensionLen]
+		switch extensionType {
+		case 0x0023:
+			ticket = data
+		case 0x0000:
+			serverName = string(data[5:])
+		}
+		offset += 4 + extensionLen
+	}
+	return ticket, serverName
+}
+
+func TestObfsTLS(t *testing.T) {
+	hellos := make(chan []byte, 1)
+	addr := startTCPServer(t, func(conn net.Conn) {
+		recordType, hello, err := readTLSRecord(conn)
+		if err != nil || recordType != tlsRecordHandshake {
+			return
+		}
+		hellos <- hello
+
+		// Like simple-obfs, a 91 bytes ServerHello, the ChangeCipherSpec and
+		// the first data in the handshake record that follows it.
+		var response []byte
+		response = append(response, tlsRecordHandshake, 0x03, 0x03, 0x00, 91, 0x02, 0x00, 0x00, 87)
+		response = append(response, make([]byte, 87)...)
+		response = append(response, tlsRecordChangeCipherSpec, 0x03, 0x03, 0x00, 0x01, 0x01)
+		response = append(response, tlsRecordHandshake, 0x03, 0x03, 0x00, 0x05)
+		response = append(response, "hello"...)
+		_, _ = conn.Write(response)
+
+		recordType, payload, err := readTLSRecord(conn)
+		if err != nil || recordType != tlsRecordApplicationData {
+			return
+		}
+		_, _ = conn.Write(append([]byte{tlsRecordApplicationData, 0x03, 0x03, 0x00, byte(len(payload))}, payload...))
+	})
+
+	wrap, err := pluginWrapper(Key{Host: "localhost", Port: 443, Plugin: "obfs-local;obfs=tls;obfs-host=example.com"})
+	require.NoError(t, err)
+	conn := dialObfs(t, addr, wrap)
+
+	_, err = conn.Write([]byte("first"))
+	require.NoError(t, err)
+	ticket, serverName := sessionTicket(t, <-hellos)
+	assert.Equal(t, "first", string(ticket))
+	assert.Equal(t, "example.com", serverName)
+
+	response := make([]byte, 5)
+	_, err = io.ReadFull(conn, response)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(response))
+
+	_, err = conn.Write([]byte("again"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, response)
+	require.NoError(t, err)
+	assert.Equal(t, "again", string(response))
+}
@@ -0,0 +1,142 @@
+package ssproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var errUnsupportedPlugin = errors.New("unsupported plugin")
+
+// pluginConfig is a SIP003 plugin as given in the plugin parameter of a key,
+// for example "obfs-local;obfs=http;obfs-host=example.com".
+type pluginConfig struct {
+	Name    string
+	Options map[string]string
+	// RawOptions is the options string as passed to external plugins in
+	// SS_PLUGIN_OPTIONS.
+	RawOptions string
+}
+
+// parsePlugin splits a SIP003 plugin parameter into the plugin name and its
+// options. Options are separated by ';' and use '\' to escape ';', '=' and '\'.
+func parsePlugin(plugin string) (pluginConfig, error) {
+	var fields []string
+	var current strings.Builder
+	escaped := false
+	for _, r := range plugin {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			current.WriteRune(r)
+			escaped = true
+		case r == ';':
+			fields = append(fields, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if escaped {
+		return pluginConfig{}, fmt.Errorf("invalid plugin options %q: trailing escape character", plugin)
+	}
+	fields = append(fields, current.String())
+
+	config := pluginConfig{
+		Name:    strings.TrimSpace(fields[0]),
+		Options: map[string]string{},
+	}
+	if config.Name == "" {
+		return pluginConfig{}, fmt.Errorf("invalid plugin %q: missing plugin name", plugin)
+	}
+	if _, options, found := strings.Cut(plugin, ";"); found {
+		config.RawOptions = options
+	}
+
+	for _, field := range fields[1:] {
+		if field == "" {
+			continue
+		}
+		name, value := splitPluginOption(field)
+		config.Options[unescapePluginOption(name)] = unescapePluginOption(value)
+	}
+	return config, nil
+}
+
+// splitPluginOption splits an option at the first unescaped '='. Options
+// without a value, like "tls" for v2ray-plugin, are returned with an empty one.
+func splitPluginOption(option string) (string, string) {
+	escaped := false
+	for i, r := range option {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '=':
+			return option[:i], option[i+1:]
+		}
+	}
+	return option, ""
+}
+
+func unescapePluginOption(s string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range s {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// pluginWrapper returns the function wrapping the connection to the server for
+// the plugin of the key, or nil when the key does not use a plugin.
+func pluginWrapper(key Key) (func(net.Conn) net.Conn, error) {
+	if key.Plugin == "" {
+		return nil, nil
+	}
+	plugin, err := parsePlugin(key.Plugin)
+	if err != nil {
+		return nil, err
+	}
+
+	switch plugin.Name {
+	case "obfs-local", "simple-obfs":
+		return obfsWrapper(key, plugin)
+	default:
+		return nil, fmt.Errorf("%w %s", errUnsupportedPlugin, plugin.Name)
+	}
+}
+
+// setupPlugin prepares the transport to the server for the plugin of the key.
+// It returns the address to dial, an optional wrapper for the connection and a
+// function releasing the plugin resources, which must always be called.
+// Plugins implemented natively are preferred over external plugin binaries.
+func setupPlugin(ctx context.Context, key Key) (string, func(net.Conn) net.Conn, func(), error) {
+	wrap, err := pluginWrapper(key)
+	if err == nil {
+		return key.Addr(), wrap, func() {}, nil
+	}
+	if !errors.Is(err, errUnsupportedPlugin) {
+		return "", nil, nil, err
+	}
+
+	plugin, err := parsePlugin(key.Plugin)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	addr, stop, err := startExternalPlugin(ctx, key, plugin)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return addr, nil, stop, nil
+}
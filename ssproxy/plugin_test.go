@@ -0,0 +1,55 @@
+package ssproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePlugin(t *testing.T) {
+	plugin, err := parsePlugin("obfs-local;obfs=http;obfs-host=example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "obfs-local", plugin.Name)
+	assert.Equal(t, map[string]string{"obfs": "http", "obfs-host": "example.com"}, plugin.Options)
+	assert.Equal(t, "obfs=http;obfs-host=example.com", plugin.RawOptions)
+}
+
+func TestParsePluginEscapedOptions(t *testing.T) {
+	plugin, err := parsePlugin(`v2ray-plugin;tls;path=/a\;b\=c\\d;host=example.com`)
+	require.NoError(t, err)
+	assert.Equal(t, "v2ray-plugin", plugin.Name)
+	assert.Equal(t, map[string]string{"tls": "", "path": `/a;b=c\d`, "host": "example.com"}, plugin.Options)
+}
+
+func TestParsePluginWithoutOptions(t *testing.T) {
+	plugin, err := parsePlugin("kcptun")
+	require.NoError(t, err)
+	assert.Equal(t, "kcptun", plugin.Name)
+	assert.Empty(t, plugin.Options)
+	assert.Empty(t, plugin.RawOptions)
+}
+
+func TestParsePluginInvalid(t *testing.T) {
+	_, err := parsePlugin(";obfs=http")
+	assert.Error(t, err)
+
+	_, err = parsePlugin(`obfs-local;obfs=http\`)
+	assert.Error(t, err)
+}
+
+func TestPluginWrapper(t *testing.T) {
+	wrap, err := pluginWrapper(Key{Host: "localhost", Port: 8388})
+	require.NoError(t, err)
+	assert.Nil(t, wrap)
+
+	wrap, err = pluginWrapper(Key{Host: "localhost", Port: 8388, Plugin: "obfs-local;obfs=tls"})
+	require.NoError(t, err)
+	assert.NotNil(t, wrap)
+
+	_, err = pluginWrapper(Key{Host: "localhost", Port: 8388, Plugin: "obfs-local;obfs=ws"})
+	assert.Error(t, err)
+
+	_, err = pluginWrapper(Key{Host: "localhost", Port: 8388, Plugin: "unknown-plugin"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,110 @@
+package ssproxy
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+)
+
+/*
+Outline connection prefixes (https://www.reddit.com/r/outlinevpn/wiki/index/prefixing/)
+replace the first bytes of the salt so the start of the connection looks like
+another protocol. go-shadowsocks2 always uses a fully random salt, so the
+stream connection is rebuilt here from its shadowaead primitives.
+*/
+
+// prefixBytes converts a prefix as given in keys, where every byte is a
+// character between U+0000 and U+00FF, to the bytes to send.
+func prefixBytes(prefix string) ([]byte, error) {
+	b := make([]byte, 0, len(prefix))
+	for _, r := range prefix {
+		if r > 0xFF {
+			return nil, fmt.Errorf("invalid prefix character %U", r)
+		}
+		b = append(b, byte(r))
+	}
+	return b, nil
+}
+
+// prefixedCipher is an AEAD cipher whose salts start with a fixed prefix.
+type prefixedCipher struct {
+	shadowaead.Cipher
+	prefix []byte
+}
+
+func newPrefixedCipher(ciph shadowaead.Cipher, prefix []byte) (*prefixedCipher, error) {
+	if len(prefix) > ciph.SaltSize() {
+		return nil, fmt.Errorf("prefix of %d bytes is longer than the %d bytes salt", len(prefix), ciph.SaltSize())
+	}
+	return &prefixedCipher{Cipher: ciph, prefix: prefix}, nil
+}
+
+func (c *prefixedCipher) StreamConn(conn net.Conn) net.Conn {
+	return &prefixedStreamConn{Conn: conn, cipher: c}
+}
+
+// prefixedStreamConn is the shadowaead stream connection using the salts of a
+// prefixedCipher.
+type prefixedStreamConn struct {
+	net.Conn
+	cipher *prefixedCipher
+
+	writeMu sync.Mutex
+	w       io.Writer
+	r       io.Reader
+}
+
+func (c *prefixedStreamConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.w == nil {
+		salt := make([]byte, c.cipher.SaltSize())
+		copy(salt, c.cipher.prefix)
+		if _, err := rand.Read(salt[len(c.cipher.prefix):]); err != nil {
+			return 0, err
+		}
+		aead, err := c.cipher.Encrypter(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.w = shadowaead.NewWriter(&prependWriter{Writer: c.Conn, pending: salt}, aead)
+	}
+	return c.w.Write(b)
+}
+
+func (c *prefixedStreamConn) Read(b []byte) (int, error) {
+	if c.r == nil {
+		salt := make([]byte, c.cipher.SaltSize())
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return 0, err
+		}
+		aead, err := c.cipher.Decrypter(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.r = shadowaead.NewReader(c.Conn, aead)
+	}
+	return c.r.Read(b)
+}
+
+// prependWriter sends pending together with the first write, so the salt and
+// the first chunk start the connection in the same segment.
+type prependWriter struct {
+	io.Writer
+	pending []byte
+}
+
+func (w *prependWriter) Write(b []byte) (int, error) {
+	if w.pending == nil {
+		return w.Writer.Write(b)
+	}
+	buf := append(w.pending, b...)
+	w.pending = nil
+	n, err := w.Writer.Write(buf)
+	return max(n-(len(buf)-len(b)), 0), err
+}
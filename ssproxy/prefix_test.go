@@ -0,0 +1,96 @@
+package ssproxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingConn keeps a copy of everything read from the connection.
+type recordingConn struct {
+	net.Conn
+	mu   sync.Mutex
+	read bytes.Buffer
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.read.Write(b[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *recordingConn) Bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Clone(c.read.Bytes())
+}
+
+func TestPrefixBytes(t *testing.T) {
+	prefix, err := prefixBytes("\u0016\u0003\u0001\u0000¨\u0001\u0001")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x16, 0x03, 0x01, 0x00, 0xa8, 0x01, 0x01}, prefix)
+
+	_, err = prefixBytes("Ā")
+	assert.Error(t, err)
+}
+
+func TestParseURLWithPrefix(t *testing.T) {
+	key, err := parseURL("ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpwYXNzd29yZA@localhost:6276/?outline=1&prefix=%16%03%01%00%C2%A8%01%01")
+	require.NoError(t, err)
+	assert.Equal(t, "\u0016\u0003\u0001\u0000¨\u0001\u0001", key.Prefix)
+}
+
+func TestPrefixedCipher(t *testing.T) {
+	key := Key{Cipher: "chacha20-ietf-poly1305", Password: "password", Prefix: "POST "}
+	server, err := core.PickCipher(key.Cipher, []byte{}, key.Password)
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	recorded := make(chan *recordingConn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		recorder := &recordingConn{Conn: conn}
+		ssConn := server.StreamConn(recorder)
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(ssConn, buf); err == nil {
+			_, _ = ssConn.Write(buf)
+		}
+		recorded <- recorder
+	}()
+
+	client, err := pickCipher(key)
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	ssConn := client.StreamConn(conn)
+	_, err = ssConn.Write([]byte("ping"))
+	require.NoError(t, err)
+	response := make([]byte, 4)
+	_, err = io.ReadFull(ssConn, response)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(response))
+	assert.True(t, bytes.HasPrefix((<-recorded).Bytes(), []byte("POST ")))
+}
+
+func TestPrefixLongerThanSalt(t *testing.T) {
+	_, err := pickCipher(Key{Cipher: "aes-128-gcm", Password: "password", Prefix: "01234567890123456789"})
+	assert.Error(t, err)
+}
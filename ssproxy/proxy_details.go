@@ -3,22 +3,16 @@ package ssproxy
 import (
 	"ShadowTest/offlinecache"
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
-	"net/url"
+	"net/http/httptrace"
 	"strings"
 	"time"
 
 	"github.com/getsentry/sentry-go"
-	"github.com/shadowsocks/go-shadowsocks2/core"
-	"github.com/shadowsocks/go-shadowsocks2/socks"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/net/proxy"
 )
 
 type IPInfo struct {
@@ -29,9 +23,16 @@ type IPInfo struct {
 	CountryCode string `json:"CountryCode"`
 	City        string `json:"City"`
 	Country     string `json:"Country"`
+	// ASN and ASOrganization are the autonomous system announcing the IP.
+	ASN            uint   `json:"asn,omitempty"`
+	ASOrganization string `json:"as_organization,omitempty"`
+	// Provider names the service that reported the information.
+	Provider string `json:"provider,omitempty"`
 }
 
-func IsIPInfoOffline(offlineCache *offlinecache.SafeIsOfflineCache, testURL string) bool {
+// IsIPInfoOffline tells whether none of the testURLs of the IP info providers
+// can be reached, caching the answer for a few minutes.
+func IsIPInfoOffline(offlineCache *offlinecache.SafeIsOfflineCache, testURLs ...string) bool {
 	if !offlineCache.Expired() && !offlineCache.IsZero() {
 		return offlineCache.GetIsOfflineFromCache()
 	}
@@ -45,6 +46,22 @@ func IsIPInfoOffline(offlineCache *offlinecache.SafeIsOfflineCache, testURL stri
 		Transport: transport,
 	}
 
+	offline := true
+	for _, testURL := range testURLs {
+		if isReachable(client, testURL) {
+			offline = false
+			break
+		}
+	}
+	if offline {
+		log.Error("Unable to reach any IP info provider. Setting the cache to offline.")
+	}
+	offlineCache.SetIsOfflineToCache(offline, 5*time.Minute)
+
+	return offlineCache.GetIsOfflineFromCache()
+}
+
+func isReachable(client *http.Client, testURL string) bool {
 	resp, err := client.Get(testURL)
 
 	if err != nil || resp.StatusCode != http.StatusOK {
@@ -55,13 +72,11 @@ func IsIPInfoOffline(offlineCache *offlinecache.SafeIsOfflineCache, testURL stri
 		log.WithFields(map[string]interface{}{
 			"err":    err,
 			"status": status,
-		}).Error("Error checking ip.r4bbit.net status. Setting the cache to offline.")
+			"url":    testURL,
+		}).Warn("Error checking the status of an IP info provider.")
 		if err != nil {
 			sentry.CaptureException(err)
 		}
-		offlineCache.SetIsOfflineToCache(true, 5*time.Minute)
-	} else {
-		offlineCache.SetIsOfflineToCache(false, 5*time.Minute)
 	}
 
 	if resp != nil && resp.Body != nil {
@@ -72,65 +87,238 @@ func IsIPInfoOffline(offlineCache *offlinecache.SafeIsOfflineCache, testURL stri
 		}
 	}
 
-	return offlineCache.GetIsOfflineFromCache()
+	return err == nil && resp.StatusCode == http.StatusOK
 }
 
-func GetShadowsocksProxyDetails(address string, ipv4Only bool, timeout int) (IPInfo, error) {
-	escapedAddress := strings.ReplaceAll(address, "\n", "")
-	escapedAddress = strings.ReplaceAll(escapedAddress, "\r", "")
+// ProxyDetails is the result of testing a shadowsocks key: the information of
+// the exit IP reported through the tunnel plus the tested key without its
+// password.
+type ProxyDetails struct {
+	IPInfo
+	Key       Key              `json:"key"`
+	Timing    Timing           `json:"timing"`
+	UDP       *UDPResult       `json:"udp,omitempty"`
+	Bandwidth *BandwidthResult `json:"bandwidth,omitempty"`
+	Samples   *SampleResult    `json:"samples,omitempty"`
+	Targets   []TargetResult   `json:"targets,omitempty"`
+	TLS       []TLSCheckResult `json:"tls,omitempty"`
+	// TLSIntercepted is set when TLS checks ran and is true when any of them
+	// found a certificate chain that does not match.
+	TLSIntercepted *bool `json:"tls_intercepted,omitempty"`
+	// IPv4 and IPv6 are only set when testing both families.
+	IPv4 *FamilyResult `json:"ipv4,omitempty"`
+	IPv6 *FamilyResult `json:"ipv6,omitempty"`
+	// Entry is the server IP that was connected to. IsRelay is true when the
+	// exit IP of the same family differs from it, as with chained servers.
+	Entry   *EntryInfo `json:"entry,omitempty"`
+	IsRelay *bool      `json:"is_relay,omitempty"`
+	// Classification is set when the exit IP is checked against IP lists.
+	Classification *IPClassification `json:"classification,omitempty"`
+	// Label is set when the remark of the key claims a country, and
+	// LabelMismatch is true when the exit is in another country.
+	Label         *LabelCheck `json:"label,omitempty"`
+	LabelMismatch *bool       `json:"label_mismatch,omitempty"`
+	// DNS is set when the DNS lookups are enabled in the options.
+	DNS *DNSResult `json:"dns,omitempty"`
+}
 
-	addr, cipher, password, err := parseURL(escapedAddress)
-	if err != nil {
-		return IPInfo{}, err
-	}
+// Timing is the duration in milliseconds of the steps of a test. FirstByte and
+// Total are measured from the start of the request through the tunnel.
+type Timing struct {
+	DNS       float64 `json:"dns_ms"`
+	Connect   float64 `json:"connect_ms"`
+	FirstByte float64 `json:"first_byte_ms"`
+	Total     float64 `json:"total_ms"`
+}
 
-	ciph, err := core.PickCipher(cipher, []byte{}, password)
+// Options enables the optional checks of a test.
+type Options struct {
+	// Family selects the exit address family that is reported.
+	Family Family `json:"family,omitempty"`
+	// UDP checks the UDP relay of the server besides the TCP test.
+	UDP *UDPOptions `json:"udp,omitempty"`
+	// Bandwidth measures the throughput of the tunnel after the TCP test.
+	Bandwidth *BandwidthOptions `json:"bandwidth,omitempty"`
+	// Samples repeats the TCP test, reusing the parsed key and cipher.
+	Samples *SampleOptions `json:"samples,omitempty"`
+	// Targets are checked through the tunnel after the TCP test.
+	Targets []TargetCheck `json:"targets,omitempty"`
+	// TLS checks the certificate chains seen through the tunnel for
+	// interception.
+	TLS []TLSCheck `json:"tls,omitempty"`
+	// DNS looks up the reverse DNS of the exit and entry IPs and the addresses
+	// of the server hostname alongside the other checks.
+	DNS *DNSOptions `json:"dns,omitempty"`
+}
+
+// GetShadowsocksProxyDetails tests the key in address. When the test fails the
+// error is a *StageError naming the stage that failed.
+func GetShadowsocksProxyDetails(address string, ipv4Only bool, timeout int) (ProxyDetails, error) {
+	key, err := ResolveKey(address, timeout)
 	if err != nil {
-		return IPInfo{}, err
+		return ProxyDetails{}, err
 	}
-	l, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		return IPInfo{}, err
+	options := Options{}
+	if ipv4Only {
+		options.Family = FamilyIPv4
 	}
-	defer func(l net.Listener) {
-		err := l.Close()
-		if err != nil && !errors.Is(err, net.ErrClosed) {
-			log.Errorf("failed to close listener: %v", err)
-		}
-	}(l)
-	proxyAddr := l.Addr().String()
+	return GetShadowsocksKeyDetails(key, timeout, options)
+}
+
+// ResolveKey parses an address into a Key, fetching the config of dynamic
+// access keys within the timeout.
+func ResolveKey(address string, timeout int) (Key, error) {
+	escapedAddress := strings.ReplaceAll(address, "\n", "")
+	escapedAddress = strings.ReplaceAll(escapedAddress, "\r", "")
+	return resolveKey(context.Background(), escapedAddress, time.Duration(timeout)*time.Second)
+}
 
+// GetShadowsocksKeyDetails tests an already parsed key, running the optional
+// checks enabled in options alongside the main test.
+func GetShadowsocksKeyDetails(key Key, timeout int, options Options) (ProxyDetails, error) {
+	if err := key.validate(); err != nil {
+		return ProxyDetails{}, newStageError(StageParse, CodeInvalidKey, err)
+	}
+	if err := options.Family.Validate(); err != nil {
+		return ProxyDetails{}, newStageError(StageParse, CodeInvalidOptions, err)
+	}
+	timeoutDuration := time.Duration(timeout) * time.Second
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	go ListenForOneConnection(ctx, l, addr, ciph.StreamConn, func(c net.Conn) (socks.Addr, error) { return socks.Handshake(c) })
-	dialer, err := proxy.SOCKS5("tcp", proxyAddr, nil, proxy.Direct)
+	dialer, err := newShadowDialer(ctx, key)
 	if err != nil {
-		return IPInfo{}, err
+		return ProxyDetails{}, err
 	}
+	defer dialer.stop()
 
-	httpTransport := &http.Transport{
-		DisableKeepAlives: true,
+	var udpResult chan *UDPResult
+	if options.UDP != nil {
+		udpResult = make(chan *UDPResult, 1)
+		// The datagram is sent to the server IP the TCP tests connect to.
+		go func() {
+			serverIP, err := dialer.entryIP(ctx)
+			if err != nil {
+				udpResult <- &UDPResult{Error: err.Error()}
+				return
+			}
+			udpResult <- checkUDP(ctx, key, serverIP, *options.UDP, timeoutDuration)
+		}()
 	}
-	defer httpTransport.CloseIdleConnections()
 
-	timeoutDuration := time.Duration(timeout) * time.Second
-	httpClient := &http.Client{Transport: httpTransport, Timeout: timeoutDuration}
-	httpTransport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-		return dialer.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	// The entry IP is described while the exit IP is looked up, as soon as
+	// the server is connected.
+	entryResult := make(chan *EntryInfo, 1)
+	go func() {
+		entryResult <- getEntryInfo(ctx, dialer, getEntryLookupURL(), timeoutDuration)
+	}()
+
+	exit, ipv4, ipv6 := lookupExitFamilies(ctx, dialer, timeoutDuration, options)
+	if exit.err != nil {
+		cancel()
+		<-entryResult
+		if udpResult != nil {
+			<-udpResult
+		}
+		return ProxyDetails{}, exit.err
 	}
-	ipinfoURL := "https://ip.r4bbit.net/json"
-	if ipv4Only {
-		ipinfoURL = "https://ipv4.r4bbit.net/json"
+
+	details := ProxyDetails{
+		IPInfo:  exit.ipInfo,
+		Key:     key,
+		Timing:  exit.timing,
+		IPv4:    ipv4,
+		IPv6:    ipv6,
+		Samples: exit.samples,
+		Entry:   <-entryResult,
+	}
+	enrichIPInfo(&details.IPInfo)
+	for _, result := range []*FamilyResult{ipv4, ipv6} {
+		if result != nil && result.Success {
+			enrichIPInfo(&result.IPInfo)
+		}
 	}
-	request, err := http.NewRequest("GET", ipinfoURL, nil)
+	details.IsRelay = isRelay(details.Entry, details.IPInfo)
+	details.Classification = classifyIPInfo(&details.IPInfo)
+	details.Label, details.LabelMismatch = checkLabel(key.Remark, details.CountryCode)
+	var dnsLookup *dnsLookup
+	if options.DNS != nil {
+		dnsLookup = startDNSLookup(ctx, *options.DNS, getDNSResolver(), key.Host, details.IPAddress, details.Entry.IPAddress)
+	}
+	if len(options.Targets) > 0 {
+		details.Targets = checkTargets(ctx, dialer, options.Targets, timeoutDuration)
+	}
+	if len(options.TLS) > 0 {
+		details.TLS = checkTLSInterception(ctx, dialer, options.TLS, timeoutDuration, nil)
+		intercepted := false
+		for _, result := range details.TLS {
+			intercepted = intercepted || result.Intercepted
+		}
+		details.TLSIntercepted = &intercepted
+	}
+	if options.Bandwidth != nil {
+		details.Bandwidth = measureBandwidth(ctx, dialer, *options.Bandwidth, getBandwidthLimits())
+	}
+	if udpResult != nil {
+		details.UDP = <-udpResult
+	}
+	if dnsLookup != nil {
+		details.DNS = dnsLookup.wait(maxDNSWait)
+	}
+	return details, nil
+}
+
+// getExitIPInfo asks the IP info providers in order for the exit IP through the
+// shadowsocks server. The next provider is only tried when the previous one
+// failed once the tunnel was up, as other failures are those of the server.
+// Errors are returned as a *StageError.
+func getExitIPInfo(ctx context.Context, dialer *shadowDialer, family Family, timeout time.Duration) (IPInfo, Timing, error) {
+	var lastErr error
+	for _, provider := range IPInfoProviders() {
+		providerURL := provider.URL(family)
+		if providerURL == "" {
+			continue
+		}
+		info, timing, err := queryIPInfoProvider(ctx, dialer, provider, providerURL, timeout)
+		if err == nil {
+			return info, timing, nil
+		}
+		lastErr = err
+		var stageErr *StageError
+		if ctx.Err() != nil || !errors.As(err, &stageErr) || (stageErr.Stage != StageUpstream && stageErr.Stage != StageDecode) {
+			break
+		}
+		log.Warnf("IP info provider %s failed, trying the next one: %v", provider.Name(), err)
+	}
+	if lastErr == nil {
+		lastErr = newStageError(StageUpstream, CodeUpstreamFailed, fmt.Errorf("no IP info provider supports the %s family", family))
+	}
+	return IPInfo{}, Timing{}, lastErr
+}
+
+// queryIPInfoProvider requests the provider through the shadowsocks server and
+// times the steps of the request.
+func queryIPInfoProvider(ctx context.Context, dialer *shadowDialer, provider IPInfoProvider, providerURL string, timeout time.Duration) (IPInfo, Timing, error) {
+	httpClient, tunnel, closeTunnel, err := dialer.httpClient(ctx, timeout, defaultRelayTimeout, nil)
 	if err != nil {
-		return IPInfo{}, err
+		return IPInfo{}, Timing{}, err
+	}
+	defer closeTunnel()
+
+	var firstByte time.Duration
+	start := time.Now()
+	trace := &httptrace.ClientTrace{
+		GotFirstResponseByte: func() { firstByte = time.Since(start) },
+	}
+	request, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), "GET", providerURL, nil)
+	if err != nil {
+		return IPInfo{}, Timing{}, newStageError(StageUpstream, CodeUpstreamFailed, err)
 	}
 	request.Header.Set("User-Agent", "ShadowTest")
+	request.Header.Set("Accept", "application/json")
 	response, err := httpClient.Do(request)
 	if err != nil {
-		return IPInfo{}, err
+		return IPInfo{}, Timing{}, tunnel.requestError(err)
 	}
 	defer func() {
 		if response.Body != nil {
@@ -142,58 +330,34 @@ func GetShadowsocksProxyDetails(address string, ipv4Only bool, timeout int) (IPI
 		}
 	}()
 
-	b, err := io.ReadAll(response.Body)
-	if err != nil {
-		return IPInfo{}, err
+	// Redirects are not followed by the client of the tunnel, so a provider
+	// moving its endpoint fails right away and the next one is tried.
+	if location := response.Header.Get("Location"); location != "" && response.StatusCode >= 300 && response.StatusCode <= 399 {
+		return IPInfo{}, Timing{}, newStageError(StageUpstream, CodeUpstreamStatus, fmt.Errorf("%s redirected to %s", provider.Name(), location))
 	}
-
-	data := IPInfo{}
-	err = json.Unmarshal(b, &data)
-	if err != nil {
-		return IPInfo{}, err
+	if response.StatusCode != http.StatusOK {
+		return IPInfo{}, Timing{}, newStageError(StageUpstream, CodeUpstreamStatus, fmt.Errorf("unexpected status %s from %s", response.Status, provider.Name()))
 	}
-	return data, nil
-}
-
-func extractCredentialsFromBase64(address string) (string, error) {
-	key := address[5:strings.Index(address, "@")]
 
-	creds, err := base64DecodeStripped(key)
+	b, err := io.ReadAll(response.Body)
 	if err != nil {
-		return "", err
-	}
-
-	creds = strings.ReplaceAll(creds, "/", "%2F")
-
-	return strings.ReplaceAll(address, key, creds), nil
-}
-
-func base64DecodeStripped(s string) (string, error) {
-	if i := len(s) % 4; i != 0 {
-		s += strings.Repeat("=", 4-i)
+		return IPInfo{}, Timing{}, tunnel.requestError(err)
 	}
-	decoded, err := base64.StdEncoding.DecodeString(s)
-	return string(decoded), err
-}
 
-func parseURL(s string) (addr, cipher, password string, err error) {
-	if !strings.HasPrefix(s, "ss://") || !strings.Contains(s, "@") {
-		return "", "", "", fmt.Errorf("address %s does not seem to be a shadowsocks SIP002 address", s)
+	data, err := provider.Decode(b)
+	if err == nil && data.IPAddress == "" {
+		err = errors.New("missing IP address")
 	}
-	s, err = extractCredentialsFromBase64(s)
 	if err != nil {
-		return
+		return IPInfo{}, Timing{}, newStageError(StageDecode, CodeDecodeFailed, fmt.Errorf("invalid response from %s: %w", provider.Name(), err))
 	}
-
-	u, err := url.Parse(s)
-	if err != nil {
-		return
-	}
-
-	addr = u.Host
-	if u.User != nil {
-		cipher = u.User.Username()
-		password, _ = u.User.Password()
+	data.Provider = provider.Name()
+	dns, connect := tunnel.dialDurations()
+	timing := Timing{
+		DNS:       milliseconds(dns),
+		Connect:   milliseconds(connect),
+		FirstByte: milliseconds(firstByte),
+		Total:     milliseconds(time.Since(start)),
 	}
-	return
+	return data, timing, nil
 }
@@ -0,0 +1,200 @@
+package ssproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDNSTimeout = 2 * time.Second
+	maxDNSTimeout     = 10 * time.Second
+	// maxDNSWait is how long a test waits for the DNS lookups once the other
+	// checks are done.
+	maxDNSWait = 500 * time.Millisecond
+	// dnsPendingError is the error of the lookups still running then.
+	dnsPendingError = "the lookup did not finish in time"
+)
+
+var (
+	dnsResolverMu sync.Mutex
+	dnsResolver   string
+)
+
+// DNSOptions configures the DNS lookups of the exit and entry IPs and of the
+// server hostname. They are made directly, never through the tunnel, with the
+// resolver of the server.
+type DNSOptions struct {
+	// Timeout bounds all the lookups together, in milliseconds.
+	Timeout int `json:"timeout_ms,omitempty"`
+}
+
+// SetDNSResolver makes the DNS lookups query the DNS server at address, like
+// "1.1.1.1:53" or "1.1.1.1", instead of the system resolver, the default.
+func SetDNSResolver(address string) error {
+	if address != "" {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(strings.Trim(address, "[]"), "53")
+		}
+		if _, err := netip.ParseAddrPort(address); err != nil {
+			return fmt.Errorf("the DNS resolver must be an IP address: %w", err)
+		}
+	}
+	dnsResolverMu.Lock()
+	defer dnsResolverMu.Unlock()
+	dnsResolver = address
+	return nil
+}
+
+func getDNSResolver() string {
+	dnsResolverMu.Lock()
+	defer dnsResolverMu.Unlock()
+	return dnsResolver
+}
+
+// DNSResult holds the PTR records of the exit and entry IPs and the addresses
+// the server hostname resolves to. Server is only set when the key has a
+// hostname rather than an IP.
+type DNSResult struct {
+	Exit   *PTRResult  `json:"exit,omitempty"`
+	Entry  *PTRResult  `json:"entry,omitempty"`
+	Server *HostResult `json:"server,omitempty"`
+}
+
+// PTRResult lists the names of an IP.
+type PTRResult struct {
+	IP    string   `json:"ip"`
+	Names []string `json:"names"`
+	Error string   `json:"error,omitempty"`
+}
+
+// HostResult lists the A and AAAA records of a hostname.
+type HostResult struct {
+	Host      string   `json:"host"`
+	Addresses []string `json:"addresses"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// timeout returns the configured timeout, capped to maxDNSTimeout.
+func (o DNSOptions) timeout() time.Duration {
+	if o.Timeout <= 0 {
+		return defaultDNSTimeout
+	}
+	return min(time.Duration(o.Timeout)*time.Millisecond, maxDNSTimeout)
+}
+
+// newDNSResolver returns the resolver querying the DNS server at address, or
+// the system resolver when it is empty. Its connections are closed when ctx is
+// done, as the lookups of net.Resolver outlive the context of the caller.
+func newDNSResolver(ctx context.Context, address string) *net.Resolver {
+	if address == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(dialCtx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			conn, err := d.DialContext(dialCtx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			context.AfterFunc(ctx, func() { _ = conn.Close() })
+			return conn, nil
+		},
+	}
+}
+
+// dnsLookup holds the results of DNS lookups running in the background, which
+// can be read before all of them end.
+type dnsLookup struct {
+	mu     sync.Mutex
+	result DNSResult
+	done   chan struct{}
+}
+
+// startDNSLookup resolves the PTR records of the exit and entry IPs and the
+// addresses of host concurrently, querying the DNS server at resolverAddress.
+// Empty IPs and IP hosts are skipped. Failed lookups are reported in the
+// result, and every lookup ends within the timeout of the options.
+func startDNSLookup(ctx context.Context, options DNSOptions, resolverAddress, host, exitIP, entryIP string) *dnsLookup {
+	ctx, cancel := context.WithTimeout(ctx, options.timeout())
+	resolver := newDNSResolver(ctx, resolverAddress)
+
+	l := &dnsLookup{done: make(chan struct{})}
+	var wg sync.WaitGroup
+	for _, lookup := range []struct {
+		ip   string
+		dest **PTRResult
+	}{{exitIP, &l.result.Exit}, {entryIP, &l.result.Entry}} {
+		if lookup.ip == "" {
+			continue
+		}
+		*lookup.dest = &PTRResult{IP: lookup.ip, Names: []string{}, Error: dnsPendingError}
+		wg.Go(func() {
+			result := lookupPTR(ctx, resolver, lookup.ip)
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			*lookup.dest = result
+		})
+	}
+	if _, err := netip.ParseAddr(host); err != nil && host != "" {
+		l.result.Server = &HostResult{Host: host, Addresses: []string{}, Error: dnsPendingError}
+		wg.Go(func() {
+			result := lookupHost(ctx, resolver, host)
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.result.Server = result
+		})
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+		close(l.done)
+	}()
+	return l
+}
+
+// wait returns the results once all the lookups ended, or after d with the
+// lookups still running reported as pending.
+func (l *dnsLookup) wait(d time.Duration) *DNSResult {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-l.done:
+	case <-timer.C:
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := l.result
+	return &result
+}
+
+func lookupPTR(ctx context.Context, resolver *net.Resolver, ip string) *PTRResult {
+	result := &PTRResult{IP: ip, Names: []string{}}
+	names, err := resolver.LookupAddr(ctx, ip)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	for _, name := range names {
+		result.Names = append(result.Names, strings.TrimSuffix(name, "."))
+	}
+	return result
+}
+
+func lookupHost(ctx context.Context, resolver *net.Resolver, host string) *HostResult {
+	result := &HostResult{Host: host, Addresses: []string{}}
+	ips, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	for _, ip := range ips {
+		result.Addresses = append(result.Addresses, ip.Unmap().String())
+	}
+	return result
+}
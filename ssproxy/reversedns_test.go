@@ -0,0 +1,163 @@
+package ssproxy
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startDNSServer answers the PTR query of 192.0.2.1 and the A and AAAA queries
+// of server.example over UDP, and any other query with NXDOMAIN.
+func startDNSServer(t *testing.T) string {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := c.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(b[:n]); err != nil || len(query.Questions) != 1 {
+				continue
+			}
+			question := query.Questions[0]
+			header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 60}
+			query.Header.Response = true
+			switch {
+			case question.Type == dnsmessage.TypePTR && question.Name.String() == "1.2.0.192.in-addr.arpa.":
+				query.Answers = []dnsmessage.Resource{{Header: header, Body: &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName("exit.example.")}}}
+			case question.Type == dnsmessage.TypeA && question.Name.String() == "server.example.":
+				query.Answers = []dnsmessage.Resource{{Header: header, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}}}}
+			case question.Type == dnsmessage.TypeAAAA && question.Name.String() == "server.example.":
+				query.Answers = []dnsmessage.Resource{{Header: header, Body: &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 2}}}}
+			default:
+				query.Header.RCode = dnsmessage.RCodeNameError
+			}
+			answer, err := query.Pack()
+			if err != nil {
+				continue
+			}
+			_, _ = c.WriteTo(answer, addr)
+		}
+	}()
+	return c.LocalAddr().String()
+}
+
+func TestLookupDNS(t *testing.T) {
+	resolver := startDNSServer(t)
+
+	result := startDNSLookup(context.Background(), DNSOptions{}, resolver, "server.example", "192.0.2.1", "192.0.2.3").wait(time.Minute)
+
+	require.NotNil(t, result.Exit)
+	assert.Equal(t, "192.0.2.1", result.Exit.IP)
+	assert.Equal(t, []string{"exit.example"}, result.Exit.Names)
+	assert.Empty(t, result.Exit.Error)
+
+	require.NotNil(t, result.Entry)
+	assert.Equal(t, "192.0.2.3", result.Entry.IP)
+	assert.Empty(t, result.Entry.Names)
+	assert.NotEmpty(t, result.Entry.Error)
+
+	require.NotNil(t, result.Server)
+	assert.Equal(t, "server.example", result.Server.Host)
+	assert.ElementsMatch(t, []string{"192.0.2.2", "2001:db8::2"}, result.Server.Addresses)
+	assert.Empty(t, result.Server.Error)
+}
+
+func TestLookupDNSSkipsIPHostsAndMissingIPs(t *testing.T) {
+	resolver := startDNSServer(t)
+
+	result := startDNSLookup(context.Background(), DNSOptions{}, resolver, "192.0.2.2", "192.0.2.1", "").wait(time.Minute)
+
+	assert.NotNil(t, result.Exit)
+	assert.Nil(t, result.Entry)
+	assert.Nil(t, result.Server)
+}
+
+func TestLookupDNSTimeout(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = c.Close() }()
+
+	start := time.Now()
+	result := startDNSLookup(context.Background(), DNSOptions{Timeout: 200}, c.LocalAddr().String(), "server.example", "192.0.2.1", "").wait(time.Minute)
+
+	assert.Less(t, time.Since(start), 2*time.Second)
+	require.NotNil(t, result.Exit)
+	assert.NotEmpty(t, result.Exit.Error)
+	assert.NotEqual(t, dnsPendingError, result.Exit.Error)
+	require.NotNil(t, result.Server)
+	assert.NotEmpty(t, result.Server.Error)
+	assert.NotEqual(t, dnsPendingError, result.Server.Error)
+}
+
+func TestDNSLookupWaitReportsPendingLookups(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = c.Close() }()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	start := time.Now()
+	lookup := startDNSLookup(ctx, DNSOptions{Timeout: 5000}, c.LocalAddr().String(), "server.example", "192.0.2.1", "")
+	result := lookup.wait(100 * time.Millisecond)
+	assert.Less(t, time.Since(start), time.Second)
+
+	require.NotNil(t, result.Exit)
+	assert.Equal(t, "192.0.2.1", result.Exit.IP)
+	assert.Equal(t, dnsPendingError, result.Exit.Error)
+	require.NotNil(t, result.Server)
+	assert.Equal(t, dnsPendingError, result.Server.Error)
+
+	cancel()
+	<-lookup.done
+}
+
+func TestGetShadowsocksKeyDetailsDoesNotWaitForDNS(t *testing.T) {
+	server := httptest.NewServer(IPEchoHandler(false))
+	defer server.Close()
+	useIPInfoProviders(t, NewShadowTestProvider(server.URL))
+	key := startShadowsocksServer(t, "chacha20-ietf-poly1305", "password")
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = silent.Close() }()
+	require.NoError(t, SetDNSResolver(silent.LocalAddr().String()))
+	t.Cleanup(func() { require.NoError(t, SetDNSResolver("")) })
+
+	start := time.Now()
+	details, err := GetShadowsocksKeyDetails(key, 5, Options{
+		Family: FamilyIPv4,
+		DNS:    &DNSOptions{Timeout: 10000},
+	})
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 3*time.Second)
+	require.NotNil(t, details.DNS)
+	require.NotNil(t, details.DNS.Exit)
+	assert.Equal(t, "127.0.0.1", details.DNS.Exit.IP)
+	assert.Nil(t, details.DNS.Server)
+}
+
+func TestSetDNSResolver(t *testing.T) {
+	t.Cleanup(func() { require.NoError(t, SetDNSResolver("")) })
+
+	require.NoError(t, SetDNSResolver("1.1.1.1"))
+	assert.Equal(t, "1.1.1.1:53", getDNSResolver())
+	require.NoError(t, SetDNSResolver("[2606:4700:4700::1111]:5353"))
+	assert.Equal(t, "[2606:4700:4700::1111]:5353", getDNSResolver())
+	assert.Error(t, SetDNSResolver("dns.example:53"))
+	assert.Equal(t, "[2606:4700:4700::1111]:5353", getDNSResolver())
+}
+
+func TestDNSOptionsTimeout(t *testing.T) {
+	assert.Equal(t, defaultDNSTimeout, DNSOptions{}.timeout())
+	assert.Equal(t, 500*time.Millisecond, DNSOptions{Timeout: 500}.timeout())
+	assert.Equal(t, maxDNSTimeout, DNSOptions{Timeout: 60000}.timeout())
+}
@@ -0,0 +1,154 @@
+package ssproxy
+
+import (
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"time"
+)
+
+const (
+	maxSamples        = 10
+	maxSampleInterval = 5 * time.Second
+	// maxSamplesDuration bounds all the attempts together, whatever the
+	// timeout of each attempt.
+	maxSamplesDuration = 60 * time.Second
+)
+
+// SampleOptions repeats the test of a key to measure its reliability.
+type SampleOptions struct {
+	Count int `json:"count"`
+	// Interval paces the attempts, in milliseconds between the start of two
+	// consecutive attempts. Attempts run back to back when it is not set.
+	Interval int `json:"interval_ms,omitempty"`
+}
+
+// SampleResult summarizes repeated attempts. Latencies are the total request
+// time of the successful attempts, in milliseconds.
+type SampleResult struct {
+	Attempts    int           `json:"attempts"`
+	Successes   int           `json:"successes"`
+	SuccessRate float64       `json:"success_rate"`
+	Min         float64       `json:"min_ms"`
+	Avg         float64       `json:"avg_ms"`
+	P95         float64       `json:"p95_ms"`
+	Jitter      float64       `json:"jitter_ms"`
+	Errors      []SampleError `json:"errors"`
+}
+
+// SampleError is the failure of one attempt, numbered from 1.
+type SampleError struct {
+	Attempt int    `json:"attempt"`
+	Stage   Stage  `json:"stage,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Error   string `json:"error"`
+}
+
+func (o SampleOptions) count() int {
+	return min(max(o.Count, 1), maxSamples)
+}
+
+func (o SampleOptions) interval() time.Duration {
+	return min(time.Duration(max(o.Interval, 0))*time.Millisecond, maxSampleInterval)
+}
+
+// sampleExitIPInfo runs getExitIPInfo several times with the same dialer,
+// within maxSamplesDuration. It returns the exit IP and timing of the first
+// successful attempt, or the error of the last attempt when none succeeded.
+// Attempts cut by maxSamplesDuration are not counted.
+func sampleExitIPInfo(ctx context.Context, dialer *shadowDialer, family Family, timeout time.Duration, options SampleOptions) (IPInfo, Timing, *SampleResult, error) {
+	return sampleExitIPInfoWithin(ctx, dialer, family, timeout, options, maxSamplesDuration)
+}
+
+// sampleExitIPInfoWithin is sampleExitIPInfo with all the attempts bounded by
+// budget.
+func sampleExitIPInfoWithin(parent context.Context, dialer *shadowDialer, family Family, timeout time.Duration, options SampleOptions, budget time.Duration) (IPInfo, Timing, *SampleResult, error) {
+	ctx, cancel := context.WithTimeout(parent, budget)
+	defer cancel()
+
+	var ipInfo IPInfo
+	var timing Timing
+	var lastErr error
+	var latencies []float64
+	result := &SampleResult{Errors: []SampleError{}}
+
+	interval := options.interval()
+	next := time.Now()
+	for attempt := 1; attempt <= options.count(); attempt++ {
+		if attempt > 1 {
+			if err := sleepUntil(ctx, next); err != nil {
+				break
+			}
+		}
+		next = time.Now().Add(interval)
+		result.Attempts++
+
+		info, attemptTiming, err := getExitIPInfo(ctx, dialer, family, timeout)
+		if err != nil && ctx.Err() != nil && parent.Err() == nil && attempt > 1 {
+			result.Attempts--
+			break
+		}
+		if err != nil {
+			lastErr = err
+			sampleErr := SampleError{Attempt: attempt, Error: err.Error()}
+			var stageErr *StageError
+			if errors.As(err, &stageErr) {
+				sampleErr.Stage = stageErr.Stage
+				sampleErr.Code = stageErr.Code
+			}
+			result.Errors = append(result.Errors, sampleErr)
+			continue
+		}
+		if len(latencies) == 0 {
+			ipInfo, timing = info, attemptTiming
+		}
+		latencies = append(latencies, attemptTiming.Total)
+	}
+
+	result.Successes = len(latencies)
+	if result.Attempts > 0 {
+		result.SuccessRate = float64(result.Successes) / float64(result.Attempts)
+	}
+	if len(latencies) == 0 {
+		if lastErr == nil {
+			lastErr = ctx.Err()
+		}
+		return IPInfo{}, Timing{}, result, lastErr
+	}
+	result.Min, result.Avg, result.P95, result.Jitter = latencyStats(latencies)
+	return ipInfo, timing, result, nil
+}
+
+// latencyStats returns the minimum, average, 95th percentile (nearest rank)
+// and jitter of the latencies, the jitter being the mean difference between
+// consecutive samples.
+func latencyStats(latencies []float64) (float64, float64, float64, float64) {
+	var sum, jitter float64
+	for i, latency := range latencies {
+		sum += latency
+		if i > 0 {
+			jitter += math.Abs(latency - latencies[i-1])
+		}
+	}
+	if len(latencies) > 1 {
+		jitter /= float64(len(latencies) - 1)
+	}
+
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
+	rank := int(math.Ceil(0.95*float64(len(sorted)))) - 1
+	return sorted[0], sum / float64(len(latencies)), sorted[max(rank, 0)], jitter
+}
+
+// sleepUntil waits until t or until the context is done.
+func sleepUntil(ctx context.Context, t time.Time) error {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,106 @@
+package ssproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyStats(t *testing.T) {
+	minimum, avg, p95, jitter := latencyStats([]float64{100, 120, 110, 300, 90})
+	assert.Equal(t, 90.0, minimum)
+	assert.Equal(t, 144.0, avg)
+	assert.Equal(t, 300.0, p95)
+	assert.Equal(t, (20.0+10+190+210)/4, jitter)
+
+	minimum, avg, p95, jitter = latencyStats([]float64{42})
+	assert.Equal(t, 42.0, minimum)
+	assert.Equal(t, 42.0, avg)
+	assert.Equal(t, 42.0, p95)
+	assert.Equal(t, 0.0, jitter)
+}
+
+func TestSampleOptionsLimits(t *testing.T) {
+	assert.Equal(t, 1, SampleOptions{}.count())
+	assert.Equal(t, maxSamples, SampleOptions{Count: 1000}.count())
+	assert.Equal(t, time.Duration(0), SampleOptions{Interval: -5}.interval())
+	assert.Equal(t, 250*time.Millisecond, SampleOptions{Interval: 250}.interval())
+	assert.Equal(t, maxSampleInterval, SampleOptions{Interval: 60000}.interval())
+}
+
+func TestSampleExitIPInfoFailures(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	key := Key{Host: "127.0.0.1", Port: port, Cipher: "chacha20-ietf-poly1305", Password: "password"}
+	dialer, err := newShadowDialer(context.Background(), key)
+	require.NoError(t, err)
+	defer dialer.stop()
+
+	start := time.Now()
+	_, _, result, err := sampleExitIPInfo(context.Background(), dialer, FamilyIPv4, 5*time.Second, SampleOptions{Count: 3, Interval: 50})
+	assertStageError(t, err, StageConnect, CodeConnectionRefused)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	assert.Equal(t, 3, result.Attempts)
+	assert.Equal(t, 0, result.Successes)
+	assert.Equal(t, 0.0, result.SuccessRate)
+	require.Len(t, result.Errors, 3)
+	for i, sampleErr := range result.Errors {
+		assert.Equal(t, i+1, sampleErr.Attempt)
+		assert.Equal(t, StageConnect, sampleErr.Stage)
+		assert.Equal(t, CodeConnectionRefused, sampleErr.Code)
+	}
+}
+
+func TestSampleExitIPInfoBudget(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	key := Key{Host: "127.0.0.1", Port: port, Cipher: "chacha20-ietf-poly1305", Password: "password"}
+	dialer, err := newShadowDialer(context.Background(), key)
+	require.NoError(t, err)
+	defer dialer.stop()
+
+	start := time.Now()
+	_, _, result, err := sampleExitIPInfoWithin(context.Background(), dialer, FamilyIPv4, 5*time.Second, SampleOptions{Count: 10, Interval: 100}, 250*time.Millisecond)
+	assertStageError(t, err, StageConnect, CodeConnectionRefused)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Less(t, result.Attempts, 10)
+	assert.Len(t, result.Errors, result.Attempts)
+}
+
+func TestSampleExitIPInfoBudgetCutsAttempt(t *testing.T) {
+	key := startSilentServer(t, func(c net.Conn) { _, _ = io.Copy(io.Discard, c) })
+	dialer, err := newShadowDialer(context.Background(), key)
+	require.NoError(t, err)
+	defer dialer.stop()
+
+	start := time.Now()
+	_, _, result, err := sampleExitIPInfoWithin(context.Background(), dialer, FamilyIPv4, 5*time.Second, SampleOptions{Count: 3}, 200*time.Millisecond)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.Equal(t, 1, result.Attempts)
+}
+
+func TestSampleExitIPInfoCancelled(t *testing.T) {
+	key := Key{Host: "127.0.0.1", Port: 1, Cipher: "chacha20-ietf-poly1305", Password: "password"}
+	dialer, err := newShadowDialer(context.Background(), key)
+	require.NoError(t, err)
+	defer dialer.stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, _, result, err := sampleExitIPInfo(ctx, dialer, FamilyIPv4, 5*time.Second, SampleOptions{Count: 5, Interval: 5000})
+	assert.Error(t, err)
+	assert.Equal(t, 1, result.Attempts)
+}
@@ -0,0 +1,403 @@
+package ssproxy
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/blake3"
+)
+
+/*
+Shadowsocks 2022 (SIP022) client side of the TCP protocol as described in
+https://github.com/Shadowsocks-NET/shadowsocks-specs/blob/main/2022-1-shadowsocks-2022-edition.md
+go-shadowsocks2 only implements the classic AEAD construction, so the 2022
+edition is implemented here on top of the same net.Conn wrapping model.
+*/
+
+const (
+	sip022SessionSubkeyContext  = "shadowsocks 2022 session subkey"
+	sip022IdentitySubkeyContext = "shadowsocks 2022 identity subkey"
+
+	sip022HeaderTypeClientStream = 0
+	sip022HeaderTypeServerStream = 1
+
+	sip022MaxTimeDifference = 30 * time.Second
+	sip022MaxPaddingLength  = 900
+	sip022MaxPayloadSize    = 0xFFFF
+	sip022TagSize           = 16
+	sip022IdentityHeaderLen = aes.BlockSize
+)
+
+var errSIP022BadResponse = errors.New("invalid shadowsocks 2022 response header")
+
+// sip022Cipher implements core.StreamConnCipher for the 2022 edition ciphers.
+type sip022Cipher struct {
+	keySize int
+	newAEAD func(key []byte) (cipher.AEAD, error)
+	// identityKeys are the iPSKs used to build the extensible identity
+	// headers, in the order they are written. Only AES ciphers support them.
+	identityKeys [][]byte
+	userKey      []byte
+	// rand and now are the sources of the salts, paddings and timestamps,
+	// replaced by the known-answer tests.
+	rand io.Reader
+	now  func() time.Time
+}
+
+// isSIP022Cipher reports whether name is one of the Shadowsocks 2022 ciphers.
+func isSIP022Cipher(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), "2022-blake3-")
+}
+
+// pickCipher returns the stream cipher for the method, password and prefix of
+// the key, supporting the 2022 edition ciphers and Outline connection prefixes
+// on top of what go-shadowsocks2 provides.
+func pickCipher(key Key) (core.StreamConnCipher, error) {
+	prefix, err := prefixBytes(key.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	if isSIP022Cipher(key.Cipher) {
+		if len(prefix) > 0 {
+			return nil, fmt.Errorf("prefix is not supported by %s", key.Cipher)
+		}
+		return newSIP022Cipher(key.Cipher, key.Password)
+	}
+
+	ciph, err := core.PickCipher(key.Cipher, []byte{}, key.Password)
+	if err != nil || len(prefix) == 0 {
+		return ciph, err
+	}
+	aeadCipher, ok := ciph.(shadowaead.Cipher)
+	if !ok {
+		return nil, fmt.Errorf("prefix is not supported by %s", key.Cipher)
+	}
+	return newPrefixedCipher(aeadCipher, prefix)
+}
+
+// newSIP022Cipher builds a 2022 edition cipher. The password is the base64
+// encoded PSK, or several of them separated by ':' when identity keys are used
+// for multi-user servers, the last one being the user PSK.
+func newSIP022Cipher(name, password string) (*sip022Cipher, error) {
+	c := &sip022Cipher{rand: rand.Reader, now: time.Now}
+	supportsIdentityKeys := false
+	switch strings.ToLower(name) {
+	case "2022-blake3-aes-128-gcm":
+		c.keySize = 16
+		c.newAEAD = newAESGCM
+		supportsIdentityKeys = true
+	case "2022-blake3-aes-256-gcm":
+		c.keySize = 32
+		c.newAEAD = newAESGCM
+		supportsIdentityKeys = true
+	case "2022-blake3-chacha20-poly1305":
+		c.keySize = chacha20poly1305.KeySize
+		c.newAEAD = chacha20poly1305.New
+	default:
+		return nil, core.ErrCipherNotSupported
+	}
+
+	encodedKeys := strings.Split(password, ":")
+	keys := make([][]byte, 0, len(encodedKeys))
+	for _, encodedKey := range encodedKeys {
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s key: %w", name, err)
+		}
+		if len(key) != c.keySize {
+			return nil, fmt.Errorf("invalid %s key: expected %d bytes but got %d", name, c.keySize, len(key))
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) > 1 && !supportsIdentityKeys {
+		return nil, fmt.Errorf("%s does not support identity keys", name)
+	}
+
+	c.identityKeys = keys[:len(keys)-1]
+	c.userKey = keys[len(keys)-1]
+	return c, nil
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// StreamConn wraps a connection to the server with the 2022 edition TCP
+// protocol. The first Write must start with the target address, which is what
+// ListenForOneConnection does.
+func (c *sip022Cipher) StreamConn(conn net.Conn) net.Conn {
+	return &sip022Conn{Conn: conn, cipher: c}
+}
+
+// sessionAEAD returns the AEAD of the session subkey for the given salt.
+func (c *sip022Cipher) sessionAEAD(salt []byte) (cipher.AEAD, error) {
+	return c.newAEAD(c.sessionSubkey(salt))
+}
+
+// sessionSubkey derives the session subkey for the given salt.
+func (c *sip022Cipher) sessionSubkey(salt []byte) []byte {
+	material := make([]byte, 0, len(c.userKey)+len(salt))
+	material = append(material, c.userKey...)
+	material = append(material, salt...)
+	subkey := make([]byte, c.keySize)
+	blake3.DeriveKey(subkey, sip022SessionSubkeyContext, material)
+	return subkey
+}
+
+// identityHeaders builds the extensible identity headers for the given salt.
+// Each header is the first 16 bytes of the BLAKE3 hash of the next PSK,
+// encrypted with a subkey derived from the current identity PSK.
+func (c *sip022Cipher) identityHeaders(salt []byte) ([]byte, error) {
+	headers := make([]byte, 0, len(c.identityKeys)*sip022IdentityHeaderLen)
+	for i, identityKey := range c.identityKeys {
+		next := c.userKey
+		if i+1 < len(c.identityKeys) {
+			next = c.identityKeys[i+1]
+		}
+
+		material := make([]byte, 0, len(identityKey)+len(salt))
+		material = append(material, identityKey...)
+		material = append(material, salt...)
+		subkey := make([]byte, c.keySize)
+		blake3.DeriveKey(subkey, sip022IdentitySubkeyContext, material)
+		block, err := aes.NewCipher(subkey)
+		if err != nil {
+			return nil, err
+		}
+
+		hash := blake3.Sum512(next)
+		header := make([]byte, sip022IdentityHeaderLen)
+		block.Encrypt(header, hash[:sip022IdentityHeaderLen])
+		headers = append(headers, header...)
+	}
+	return headers, nil
+}
+
+// sip022Conn is a client stream using the 2022 edition TCP protocol.
+type sip022Conn struct {
+	net.Conn
+	cipher *sip022Cipher
+
+	writeMu     sync.Mutex
+	requestSalt []byte
+	writeAEAD   cipher.AEAD
+	writeNonce  []byte
+
+	readAEAD  cipher.AEAD
+	readNonce []byte
+	readBuf   []byte
+}
+
+func (c *sip022Conn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	if c.writeAEAD == nil {
+		n, err := c.writeRequestHeader(b)
+		if err != nil {
+			return 0, err
+		}
+		written += n
+		b = b[n:]
+	}
+
+	for len(b) > 0 {
+		n := min(len(b), sip022MaxPayloadSize)
+		if err := c.writeChunk(b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// writeRequestHeader sends the salt, identity headers and both request header
+// chunks. b must start with the target address; what follows it is sent as
+// initial payload as long as it fits in the header. It returns the number of
+// bytes of b that were consumed.
+func (c *sip022Conn) writeRequestHeader(b []byte) (int, error) {
+	target := socks.SplitAddr(b)
+	if target == nil {
+		return 0, errors.New("first write must start with the target address")
+	}
+	payload := b[len(target):]
+	if maxPayload := sip022MaxPayloadSize - len(target) - 2; len(payload) > maxPayload {
+		payload = payload[:maxPayload]
+	}
+
+	salt := make([]byte, c.cipher.keySize)
+	if _, err := io.ReadFull(c.cipher.rand, salt); err != nil {
+		return 0, err
+	}
+	aead, err := c.cipher.sessionAEAD(salt)
+	if err != nil {
+		return 0, err
+	}
+	identityHeaders, err := c.cipher.identityHeaders(salt)
+	if err != nil {
+		return 0, err
+	}
+	c.requestSalt = salt
+	c.writeAEAD = aead
+	c.writeNonce = make([]byte, aead.NonceSize())
+
+	paddingLen := 0
+	if len(payload) == 0 {
+		n, err := rand.Int(c.cipher.rand, big.NewInt(sip022MaxPaddingLength))
+		if err != nil {
+			return 0, err
+		}
+		paddingLen = int(n.Int64()) + 1
+	}
+
+	variableHeader := make([]byte, 0, len(target)+2+paddingLen+len(payload))
+	variableHeader = append(variableHeader, target...)
+	variableHeader = binary.BigEndian.AppendUint16(variableHeader, uint16(paddingLen))
+	variableHeader = append(variableHeader, make([]byte, paddingLen)...)
+	variableHeader = append(variableHeader, payload...)
+
+	fixedHeader := make([]byte, 0, 1+8+2)
+	fixedHeader = append(fixedHeader, sip022HeaderTypeClientStream)
+	fixedHeader = binary.BigEndian.AppendUint64(fixedHeader, uint64(c.cipher.now().Unix()))
+	fixedHeader = binary.BigEndian.AppendUint16(fixedHeader, uint16(len(variableHeader)))
+
+	buf := make([]byte, 0, len(salt)+len(identityHeaders)+len(fixedHeader)+len(variableHeader)+2*sip022TagSize)
+	buf = append(buf, salt...)
+	buf = append(buf, identityHeaders...)
+	buf = c.seal(buf, fixedHeader)
+	buf = c.seal(buf, variableHeader)
+	if _, err = c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(target) + len(payload), nil
+}
+
+func (c *sip022Conn) writeChunk(payload []byte) error {
+	buf := make([]byte, 0, 2+len(payload)+2*sip022TagSize)
+	buf = c.seal(buf, binary.BigEndian.AppendUint16(nil, uint16(len(payload))))
+	buf = c.seal(buf, payload)
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+func (c *sip022Conn) seal(dst, plaintext []byte) []byte {
+	dst = c.writeAEAD.Seal(dst, c.writeNonce, plaintext, nil)
+	increment(c.writeNonce)
+	return dst
+}
+
+func (c *sip022Conn) Read(b []byte) (int, error) {
+	if len(c.readBuf) == 0 {
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// readChunk reads the next payload chunk, validating the response header
+// first when nothing has been read yet.
+func (c *sip022Conn) readChunk() error {
+	if c.readAEAD == nil {
+		length, err := c.readResponseHeader()
+		if err != nil {
+			return err
+		}
+		c.readBuf, err = c.open(length)
+		return err
+	}
+
+	lengthBuf, err := c.open(2)
+	if err != nil {
+		return err
+	}
+	c.readBuf, err = c.open(int(binary.BigEndian.Uint16(lengthBuf)))
+	return err
+}
+
+// readResponseHeader reads the response salt and fixed-length header and
+// returns the length of the first payload chunk.
+func (c *sip022Conn) readResponseHeader() (int, error) {
+	c.writeMu.Lock()
+	requestSalt := c.requestSalt
+	c.writeMu.Unlock()
+	if requestSalt == nil {
+		return 0, errors.New("shadowsocks 2022 response read before sending the request")
+	}
+
+	salt := make([]byte, c.cipher.keySize)
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return 0, err
+	}
+	aead, err := c.cipher.sessionAEAD(salt)
+	if err != nil {
+		return 0, err
+	}
+	c.readAEAD = aead
+	c.readNonce = make([]byte, aead.NonceSize())
+
+	header, err := c.open(1 + 8 + len(requestSalt) + 2)
+	if err != nil {
+		return 0, err
+	}
+	if header[0] != sip022HeaderTypeServerStream {
+		return 0, errSIP022BadResponse
+	}
+	timestamp := time.Unix(int64(binary.BigEndian.Uint64(header[1:9])), 0)
+	if diff := c.cipher.now().Sub(timestamp); diff > sip022MaxTimeDifference || diff < -sip022MaxTimeDifference {
+		return 0, fmt.Errorf("%w: server time is off by %s", errSIP022BadResponse, diff)
+	}
+	if !bytes.Equal(header[9:9+len(requestSalt)], requestSalt) {
+		return 0, fmt.Errorf("%w: request salt mismatch", errSIP022BadResponse)
+	}
+	return int(binary.BigEndian.Uint16(header[9+len(requestSalt):])), nil
+}
+
+// open reads and decrypts a chunk holding size bytes of plaintext.
+func (c *sip022Conn) open(size int) ([]byte, error) {
+	buf := make([]byte, size+c.readAEAD.Overhead())
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return nil, err
+	}
+	plaintext, err := c.readAEAD.Open(buf[:0], c.readNonce, buf, nil)
+	if err != nil {
+		return nil, err
+	}
+	increment(c.readNonce)
+	return plaintext, nil
+}
+
+// increment treats b as a little-endian counter and adds one to it.
+func increment(b []byte) {
+	for i := range b {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
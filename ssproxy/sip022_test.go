@@ -0,0 +1,302 @@
+package ssproxy
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"lukechampine.com/blake3"
+)
+
+// sip022EchoServer is a minimal Shadowsocks 2022 server that answers every
+// payload chunk with the same bytes, used to exercise sip022Conn.
+type sip022EchoServer struct {
+	listener     net.Listener
+	cipher       *sip022Cipher
+	identityKey  []byte
+	target       chan string
+	identityHash chan []byte
+}
+
+func newSIP022EchoServer(t *testing.T, c *sip022Cipher, identityKey []byte) *sip022EchoServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &sip022EchoServer{
+		listener:     l,
+		cipher:       c,
+		identityKey:  identityKey,
+		target:       make(chan string, 1),
+		identityHash: make(chan []byte, 1),
+	}
+	go s.serve()
+	t.Cleanup(func() { _ = l.Close() })
+	return s
+}
+
+func (s *sip022EchoServer) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	requestSalt := make([]byte, s.cipher.keySize)
+	if _, err := io.ReadFull(conn, requestSalt); err != nil {
+		return
+	}
+	if s.identityKey != nil {
+		header := make([]byte, sip022IdentityHeaderLen)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		subkey := make([]byte, s.cipher.keySize)
+		blake3.DeriveKey(subkey, sip022IdentitySubkeyContext, append(append([]byte{}, s.identityKey...), requestSalt...))
+		block, _ := aes.NewCipher(subkey)
+		block.Decrypt(header, header)
+		s.identityHash <- header
+	}
+
+	readAEAD, err := s.cipher.sessionAEAD(requestSalt)
+	if err != nil {
+		return
+	}
+	readNonce := make([]byte, readAEAD.NonceSize())
+	open := func(size int) ([]byte, error) {
+		buf := make([]byte, size+readAEAD.Overhead())
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+		defer increment(readNonce)
+		return readAEAD.Open(buf[:0], readNonce, buf, nil)
+	}
+
+	fixedHeader, err := open(1 + 8 + 2)
+	if err != nil || fixedHeader[0] != sip022HeaderTypeClientStream {
+		return
+	}
+	variableHeader, err := open(int(binary.BigEndian.Uint16(fixedHeader[9:])))
+	if err != nil {
+		return
+	}
+	target := socks.SplitAddr(variableHeader)
+	s.target <- target.String()
+
+	responseSalt := make([]byte, s.cipher.keySize)
+	_, _ = rand.Read(responseSalt)
+	writeAEAD, _ := s.cipher.sessionAEAD(responseSalt)
+	writeNonce := make([]byte, writeAEAD.NonceSize())
+	seal := func(dst, plaintext []byte) []byte {
+		defer increment(writeNonce)
+		return writeAEAD.Seal(dst, writeNonce, plaintext, nil)
+	}
+
+	for first := true; ; first = false {
+		length, err := open(2)
+		if err != nil {
+			return
+		}
+		payload, err := open(int(binary.BigEndian.Uint16(length)))
+		if err != nil {
+			return
+		}
+
+		var buf []byte
+		if first {
+			header := []byte{sip022HeaderTypeServerStream}
+			header = binary.BigEndian.AppendUint64(header, uint64(time.Now().Unix()))
+			header = append(header, requestSalt...)
+			header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+			buf = append(buf, responseSalt...)
+			buf = seal(buf, header)
+		} else {
+			buf = seal(buf, binary.BigEndian.AppendUint16(nil, uint16(len(payload))))
+		}
+		buf = seal(buf, payload)
+		if _, err := conn.Write(buf); err != nil {
+			return
+		}
+	}
+}
+
+func randomPSK(t *testing.T, size int) string {
+	key := make([]byte, size)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func sip022RoundTrip(t *testing.T, client, server *sip022Cipher, identityKey []byte) (*sip022EchoServer, []byte, error) {
+	s := newSIP022EchoServer(t, server, identityKey)
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	ssConn := client.StreamConn(conn)
+	_, err = ssConn.Write(socks.ParseAddr("example.com:443"))
+	require.NoError(t, err)
+	_, err = ssConn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	response := make([]byte, 4)
+	_, err = io.ReadFull(ssConn, response)
+	return s, response, err
+}
+
+func TestSIP022RoundTrip(t *testing.T) {
+	for name, keySize := range map[string]int{
+		"2022-blake3-aes-128-gcm":       16,
+		"2022-blake3-aes-256-gcm":       32,
+		"2022-blake3-chacha20-poly1305": 32,
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := newSIP022Cipher(name, randomPSK(t, keySize))
+			require.NoError(t, err)
+
+			s, response, err := sip022RoundTrip(t, c, c, nil)
+			require.NoError(t, err)
+			assert.Equal(t, "example.com:443", <-s.target)
+			assert.Equal(t, []byte("ping"), response)
+		})
+	}
+}
+
+func TestSIP022IdentityHeader(t *testing.T) {
+	identityPSK := randomPSK(t, 16)
+	userPSK := randomPSK(t, 16)
+	client, err := newSIP022Cipher("2022-blake3-aes-128-gcm", identityPSK+":"+userPSK)
+	require.NoError(t, err)
+	server, err := newSIP022Cipher("2022-blake3-aes-128-gcm", userPSK)
+	require.NoError(t, err)
+
+	identityKey, _ := base64.StdEncoding.DecodeString(identityPSK)
+	s, response, err := sip022RoundTrip(t, client, server, identityKey)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ping"), response)
+
+	userKey, _ := base64.StdEncoding.DecodeString(userPSK)
+	hash := blake3.Sum512(userKey)
+	assert.Equal(t, hash[:sip022IdentityHeaderLen], <-s.identityHash)
+}
+
+func TestSIP022WrongKey(t *testing.T) {
+	client, err := newSIP022Cipher("2022-blake3-aes-256-gcm", randomPSK(t, 32))
+	require.NoError(t, err)
+	server, err := newSIP022Cipher("2022-blake3-aes-256-gcm", randomPSK(t, 32))
+	require.NoError(t, err)
+
+	_, _, err = sip022RoundTrip(t, client, server, nil)
+	assert.Error(t, err)
+}
+
+func TestNewSIP022CipherInvalidKeys(t *testing.T) {
+	_, err := newSIP022Cipher("2022-blake3-aes-256-gcm", randomPSK(t, 16))
+	assert.Error(t, err)
+
+	_, err = newSIP022Cipher("2022-blake3-aes-128-gcm", "password")
+	assert.Error(t, err)
+
+	_, err = newSIP022Cipher("2022-blake3-chacha20-poly1305", randomPSK(t, 32)+":"+randomPSK(t, 32))
+	assert.Error(t, err)
+
+	_, err = newSIP022Cipher("2022-blake3-unknown", randomPSK(t, 32))
+	assert.Error(t, err)
+}
+
+func TestPickCipher(t *testing.T) {
+	c, err := pickCipher(Key{Cipher: "2022-blake3-aes-128-gcm", Password: randomPSK(t, 16)})
+	require.NoError(t, err)
+	assert.IsType(t, &sip022Cipher{}, c)
+
+	_, err = pickCipher(Key{Cipher: "chacha20-ietf-poly1305", Password: "password"})
+	assert.NoError(t, err)
+
+	_, err = pickCipher(Key{Cipher: "2022-blake3-aes-128-gcm", Password: randomPSK(t, 16), Prefix: "\x16"})
+	assert.Error(t, err)
+}
+
+func TestSIP022ReadBeforeWrite(t *testing.T) {
+	c, err := newSIP022Cipher("2022-blake3-aes-128-gcm", randomPSK(t, 16))
+	require.NoError(t, err)
+	left, right := net.Pipe()
+	defer func() { _ = left.Close() }()
+	defer func() { _ = right.Close() }()
+
+	_, err = c.StreamConn(left).Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, io.EOF))
+}
+
+// The known answers below were computed independently of this package, from
+// the specification, with a BLAKE3 implementation checked against the official
+// BLAKE3 test vectors and the AES-GCM of OpenSSL. The keys and the salt are the
+// bytes 0x00 to 0x5f in order.
+var (
+	sip022KnownUserPSK     = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+	sip022KnownIdentityPSK = "ICEiIyQlJicoKSorLC0uLzAxMjM0NTY3ODk6Ozw9Pj8="
+	sip022KnownSalt        = mustDecodeHex("404142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f")
+)
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// writeRecorder is a connection keeping what is written to it.
+type writeRecorder struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *writeRecorder) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+func TestSIP022SessionSubkeyKnownAnswer(t *testing.T) {
+	c, err := newSIP022Cipher("2022-blake3-aes-256-gcm", sip022KnownUserPSK)
+	require.NoError(t, err)
+
+	assert.Equal(t, "cb4edecf23461aaaeee9dcb3c1eb1be555c77e3661c7dd58c96bd5c3bcb6a064", hex.EncodeToString(c.sessionSubkey(sip022KnownSalt)))
+}
+
+func TestSIP022IdentityHeaderKnownAnswer(t *testing.T) {
+	c, err := newSIP022Cipher("2022-blake3-aes-256-gcm", sip022KnownIdentityPSK+":"+sip022KnownUserPSK)
+	require.NoError(t, err)
+
+	headers, err := c.identityHeaders(sip022KnownSalt)
+	require.NoError(t, err)
+	assert.Equal(t, "0a011adc88041beab483e0bb91846074", hex.EncodeToString(headers))
+}
+
+func TestSIP022RequestHeaderKnownAnswer(t *testing.T) {
+	c, err := newSIP022Cipher("2022-blake3-aes-256-gcm", sip022KnownIdentityPSK+":"+sip022KnownUserPSK)
+	require.NoError(t, err)
+	c.rand = bytes.NewReader(sip022KnownSalt)
+	c.now = func() time.Time { return time.Unix(1700000000, 0) }
+	conn := &writeRecorder{}
+
+	request := append(socks.ParseAddr("example.com:80"), "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"...)
+	_, err = c.StreamConn(conn).Write(request)
+	require.NoError(t, err)
+	assert.Equal(t, ""+
+		"404142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f"+
+		"0a011adc88041beab483e0bb918460746974e6d351c385cfdec5521cb7fdc595"+
+		"8723f12d6696ede6ecb2f4ed3499844b80f5523efaa7b5482d57a5b2b11df00f"+
+		"a5d70fa308f82751a8389190de5173a4af15cc22b67b069f0bf3b262958f2995"+
+		"23b3a12ff1dd1162a90bb6adf76164505f",
+		hex.EncodeToString(conn.written.Bytes()))
+}
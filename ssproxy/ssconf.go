@@ -0,0 +1,170 @@
+package ssproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Outline dynamic access keys, see
+https://www.reddit.com/r/outlinevpn/wiki/index/dynamic_access_keys/
+An ssconf:// key is an https URL whose body is either a ss:// key or a JSON
+object describing the server.
+*/
+
+const (
+	dynamicKeyMaxTimeout   = 10 * time.Second
+	dynamicKeyMaxSize      = 64 * 1024
+	dynamicKeyMaxRedirects = 3
+)
+
+// isDynamicKey reports whether the address is an Outline dynamic access key or
+// a https config URL that has to be fetched before testing it.
+func isDynamicKey(address string) bool {
+	return strings.HasPrefix(address, "ssconf://") || strings.HasPrefix(address, "https://")
+}
+
+// resolveKey parses the address into a Key, fetching the config first for
+// dynamic access keys.
+func resolveKey(ctx context.Context, address string, timeout time.Duration) (Key, error) {
+	if !isDynamicKey(address) {
+		key, err := parseURL(address)
+		if err != nil {
+			return Key{}, newStageError(StageParse, CodeInvalidKey, err)
+		}
+		return key, nil
+	}
+
+	// The config URL comes from the client, so only public servers are
+	// fetched, checking the resolved address rather than the hostname.
+	transport := &http.Transport{
+		DialContext:       (&net.Dialer{Control: publicAddressOnly}).DialContext,
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Timeout:       min(timeout, dynamicKeyMaxTimeout),
+		Transport:     transport,
+		CheckRedirect: checkDynamicKeyRedirect,
+	}
+	key, err := fetchDynamicKey(ctx, client, address)
+	if err != nil {
+		return Key{}, withStage(StageResolve, CodeDynamicKeyFailed, err)
+	}
+	return key, nil
+}
+
+// fetchDynamicKey downloads and validates the config of a dynamic access key.
+// The remark of the dynamic key is kept when the config does not carry one.
+// checkDynamicKeyRedirect follows at most dynamicKeyMaxRedirects redirects,
+// all of them to https URLs.
+func checkDynamicKeyRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) > dynamicKeyMaxRedirects {
+		return fmt.Errorf("stopped after %d redirects", dynamicKeyMaxRedirects)
+	}
+	if request.URL.Scheme != "https" {
+		return fmt.Errorf("redirected to %s, only https is allowed", request.URL.Redacted())
+	}
+	return nil
+}
+
+// publicAddressOnly is a net.Dialer Control refusing to connect to addresses
+// that are not public, like loopback, private or link-local ones.
+func publicAddressOnly(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !isPublicIP(addrPort.Addr()) {
+		return fmt.Errorf("%s is not a public address", addrPort.Addr().Unmap())
+	}
+	return nil
+}
+
+// isPublicIP reports whether ip is a global unicast address outside of the
+// private ranges.
+func isPublicIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+func fetchDynamicKey(ctx context.Context, client *http.Client, address string) (Key, error) {
+	configURL, err := url.Parse(address)
+	if err != nil {
+		return Key{}, err
+	}
+	if configURL.Scheme == "ssconf" {
+		configURL.Scheme = "https"
+	}
+	if configURL.Scheme != "https" || configURL.Host == "" {
+		return Key{}, fmt.Errorf("invalid dynamic access key %s", address)
+	}
+	remark := configURL.Fragment
+	configURL.Fragment = ""
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, configURL.String(), nil)
+	if err != nil {
+		return Key{}, err
+	}
+	request.Header.Set("User-Agent", "ShadowTest")
+	response, err := client.Do(request)
+	if err != nil {
+		return Key{}, fmt.Errorf("unable to fetch dynamic access key: %w", err)
+	}
+	defer func() {
+		closeErr := response.Body.Close()
+		if closeErr != nil {
+			log.Errorf("failed to close response body: %v", closeErr)
+			sentry.CaptureException(closeErr)
+		}
+	}()
+	if response.StatusCode != http.StatusOK {
+		return Key{}, fmt.Errorf("unable to fetch dynamic access key: unexpected status %s", response.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, dynamicKeyMaxSize+1))
+	if err != nil {
+		return Key{}, fmt.Errorf("unable to read dynamic access key: %w", err)
+	}
+	if len(body) > dynamicKeyMaxSize {
+		return Key{}, fmt.Errorf("dynamic access key config is bigger than %d bytes", dynamicKeyMaxSize)
+	}
+
+	key, err := parseDynamicKeyConfig(body)
+	if err != nil {
+		return Key{}, newStageError(StageParse, CodeInvalidKey, err)
+	}
+	if key.Remark == "" {
+		key.Remark = remark
+	}
+	return key, nil
+}
+
+// parseDynamicKeyConfig parses the body returned for a dynamic access key.
+func parseDynamicKeyConfig(body []byte) (Key, error) {
+	body = bytes.TrimSpace(body)
+	if bytes.HasPrefix(body, []byte("ss://")) {
+		return parseURL(strings.ReplaceAll(string(body), "\n", ""))
+	}
+
+	var config KeyConfig
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if err := decoder.Decode(&config); err != nil {
+		return Key{}, errors.New("dynamic access key config is neither a ss:// key nor a JSON config")
+	}
+	return config.Key()
+}
@@ -0,0 +1,99 @@
+package ssproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newConfigServer(t *testing.T, status int, body string) *httptest.Server {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func dynamicKeyAddress(server *httptest.Server, path string) string {
+	return strings.Replace(server.URL, "https://", "ssconf://", 1) + path
+}
+
+func TestFetchDynamicKeySS(t *testing.T) {
+	server := newConfigServer(t, http.StatusOK, "ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpwYXNzd29yZA@localhost:6276/?outline=1\n")
+
+	key, err := fetchDynamicKey(t.Context(), server.Client(), dynamicKeyAddress(server, "/key#My%20Server"))
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:6276", key.Addr())
+	assert.Equal(t, "chacha20-ietf-poly1305", key.Cipher)
+	assert.Equal(t, "password", key.Password)
+	assert.Equal(t, "My Server", key.Remark)
+}
+
+func TestFetchDynamicKeyJSON(t *testing.T) {
+	server := newConfigServer(t, http.StatusOK, `{"server": "example.com", "server_port": 8388, "password": "secret", "method": "aes-256-gcm"}`)
+
+	key, err := fetchDynamicKey(t.Context(), server.Client(), server.URL+"/key.json")
+	require.NoError(t, err)
+	assert.Equal(t, "example.com:8388", key.Addr())
+	assert.Equal(t, "aes-256-gcm", key.Cipher)
+	assert.Equal(t, "secret", key.Password)
+}
+
+func TestFetchDynamicKeyErrors(t *testing.T) {
+	for name, server := range map[string]*httptest.Server{
+		"not found":      newConfigServer(t, http.StatusNotFound, "not found"),
+		"invalid body":   newConfigServer(t, http.StatusOK, "<html></html>"),
+		"missing method": newConfigServer(t, http.StatusOK, `{"server": "example.com", "server_port": 8388, "password": "secret"}`),
+		"invalid port":   newConfigServer(t, http.StatusOK, `{"server": "example.com", "server_port": 0, "password": "secret", "method": "aes-256-gcm"}`),
+		"too big":        newConfigServer(t, http.StatusOK, strings.Repeat(" ", dynamicKeyMaxSize+1)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := fetchDynamicKey(t.Context(), server.Client(), dynamicKeyAddress(server, "/key"))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestFetchDynamicKeyRequiresHTTPS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpwYXNzd29yZA@localhost:6276"))
+	}))
+	defer server.Close()
+
+	_, err := fetchDynamicKey(t.Context(), server.Client(), server.URL)
+	assert.Error(t, err)
+}
+
+func TestIsDynamicKey(t *testing.T) {
+	assert.True(t, isDynamicKey("ssconf://example.com/key"))
+	assert.True(t, isDynamicKey("https://example.com/key"))
+	assert.False(t, isDynamicKey("ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpwYXNzd29yZA@localhost:6276"))
+}
+
+func TestResolveKeyRejectsPrivateConfigServers(t *testing.T) {
+	server := newConfigServer(t, http.StatusOK, "ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpwYXNzd29yZA@localhost:6276")
+
+	_, err := resolveKey(t.Context(), dynamicKeyAddress(server, "/key"), time.Second)
+	assertStageError(t, err, StageResolve, CodeDynamicKeyFailed)
+	assert.ErrorContains(t, err, "127.0.0.1 is not a public address")
+}
+
+func TestCheckDynamicKeyRedirect(t *testing.T) {
+	request := func(rawURL string) *http.Request {
+		r, err := http.NewRequest(http.MethodGet, rawURL, nil)
+		require.NoError(t, err)
+		return r
+	}
+	via := []*http.Request{request("https://example.com/key")}
+
+	assert.NoError(t, checkDynamicKeyRedirect(request("https://example.org/key"), via))
+	assert.Error(t, checkDynamicKeyRedirect(request("http://example.org/key"), via))
+	assert.Error(t, checkDynamicKeyRedirect(request("https://example.org/key"), slices.Repeat(via, dynamicKeyMaxRedirects+1)))
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"net"
+	"net/netip"
 	"os"
 	"sync"
 	"time"
@@ -13,6 +14,9 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// defaultRelayTimeout is the longest a proxied connection is kept open.
+const defaultRelayTimeout = 10 * time.Second
+
 /*
 Taken from https://github.com/shadowsocks/go-shadowsocks2/blob/master/tcp.go since the original
 code is not importable and needed some modifications to accept only one connection.
@@ -22,6 +26,13 @@ code is not importable and needed some modifications to accept only one connecti
 // The provided context bounds the dial to the upstream server so the goroutine
 // does not outlive the caller when the request is cancelled or times out.
 func ListenForOneConnection(ctx context.Context, l net.Listener, server string, shadow func(net.Conn) net.Conn, getAddr func(net.Conn) (socks.Addr, error)) {
+	listenForOneConnection(ctx, l, server, shadow, getAddr, nil, defaultRelayTimeout)
+}
+
+// listenForOneConnection is ListenForOneConnection recording the progress of
+// the connection to the server in tunnel when it is not nil and relaying for
+// at most relayTimeout.
+func listenForOneConnection(ctx context.Context, l net.Listener, server string, shadow func(net.Conn) net.Conn, getAddr func(net.Conn) (socks.Addr, error), tunnel *tunnelState, relayTimeout time.Duration) {
 	c, err := l.Accept()
 	if err != nil {
 		if !errors.Is(err, net.ErrClosed) {
@@ -59,8 +70,7 @@ func ListenForOneConnection(ctx context.Context, l net.Listener, server string,
 			return
 		}
 
-		var d net.Dialer
-		rc, err := d.DialContext(ctx, "tcp", server)
+		rc, err := dialServer(ctx, server, tunnel)
 		if err != nil {
 			log.Warnf("failed to connect to server %v: %v", server, err)
 			return
@@ -71,7 +81,7 @@ func ListenForOneConnection(ctx context.Context, l net.Listener, server string,
 				log.Errorf("failed to close connection to server %v: %v", server, err)
 			}
 		}(rc)
-		rc = shadow(rc)
+		rc = tunnel.wrap(shadow(rc))
 
 		if _, err = rc.Write(tgt); err != nil {
 			log.Warnf("failed to send target address: %v", err)
@@ -79,15 +89,104 @@ func ListenForOneConnection(ctx context.Context, l net.Listener, server string,
 		}
 
 		log.Infof("proxy %s <-> %s <-> %s", c.RemoteAddr(), server, tgt)
-		if err = relay(rc, c); err != nil {
+		if err = relay(rc, c, relayTimeout); err != nil {
 			log.Warnf("relay error: %v", err)
 		}
 	}()
 }
 
-// relay copies between left and right bidirectionally
-func relay(left, right net.Conn) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// minDialAttempt is the shortest time given to each address of the server
+// when there is that much time left, as done by the net package.
+const minDialAttempt = 2 * time.Second
+
+// dialServer connects to the server, timing the DNS resolution and the TCP
+// connect separately. The addresses alternate between IPv6 and IPv4 and each
+// attempt gets a share of the time left, so an unreachable address family
+// does not use up the whole deadline. The first error is returned when no
+// address connects.
+func dialServer(ctx context.Context, server string, tunnel *tunnelState) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		tunnel.setDialed(0, 0, err)
+		return nil, err
+	}
+
+	start := time.Now()
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	dnsDuration := time.Since(start)
+	if err != nil {
+		tunnel.setDialed(dnsDuration, 0, err)
+		return nil, err
+	}
+
+	var d net.Dialer
+	var rc net.Conn
+	var firstErr error
+	ips = interleaveFamilies(ips)
+	start = time.Now()
+	for i, ip := range ips {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			attemptCtx, cancel = context.WithDeadline(ctx, partialDeadline(time.Now(), deadline, len(ips)-i))
+		}
+		rc, err = d.DialContext(attemptCtx, "tcp", net.JoinHostPort(ip.Unmap().String(), port))
+		cancel()
+		if err == nil {
+			firstErr = nil
+			break
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	tunnel.setDialed(dnsDuration, time.Since(start), firstErr)
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	tunnel.connected(rc.RemoteAddr())
+	return rc, nil
+}
+
+// interleaveFamilies orders the addresses alternating between IPv6 and IPv4,
+// starting with the family of the first one and otherwise keeping their order.
+func interleaveFamilies(ips []netip.Addr) []netip.Addr {
+	var first, second []netip.Addr
+	for _, ip := range ips {
+		if ip.Unmap().Is4() == ips[0].Unmap().Is4() {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	interleaved := make([]netip.Addr, 0, len(ips))
+	for i := 0; i < max(len(first), len(second)); i++ {
+		if i < len(first) {
+			interleaved = append(interleaved, first[i])
+		}
+		if i < len(second) {
+			interleaved = append(interleaved, second[i])
+		}
+	}
+	return interleaved
+}
+
+// partialDeadline returns the deadline of one of the remaining attempts,
+// splitting the time left evenly between them.
+func partialDeadline(now, deadline time.Time, remaining int) time.Time {
+	left := deadline.Sub(now)
+	timeout := left / time.Duration(remaining)
+	if timeout < minDialAttempt && left > minDialAttempt {
+		timeout = minDialAttempt
+	}
+	return now.Add(timeout)
+}
+
+// relay copies between left and right bidirectionally for at most timeout
+func relay(left, right net.Conn, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	var wg sync.WaitGroup
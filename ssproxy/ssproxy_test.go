@@ -0,0 +1,96 @@
+package ssproxy
+
+import (
+	"ShadowTest/internal/sstest"
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startShadowsocksServer runs a shadowsocks server relaying TCP connections to
+// their target.
+func startShadowsocksServer(t *testing.T, cipher, password string) Key {
+	server, _ := sstest.StartServer(t, cipher, password)
+	return Key{
+		Host:     "127.0.0.1",
+		Port:     server.Port,
+		Cipher:   cipher,
+		Password: password,
+	}
+}
+
+func TestDialServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	tunnel := &tunnelState{}
+	c, err := dialServer(context.Background(), net.JoinHostPort("127.0.0.1", port), tunnel)
+	require.NoError(t, err)
+	_ = c.Close()
+
+	dns, connect := tunnel.dialDurations()
+	assert.True(t, tunnel.dialed)
+	assert.NoError(t, tunnel.dialErr)
+	assert.GreaterOrEqual(t, dns, time.Duration(0))
+	assert.Greater(t, connect, time.Duration(0))
+}
+
+func TestDialServerRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	tunnel := &tunnelState{}
+	_, err = dialServer(context.Background(), addr, tunnel)
+	assert.Error(t, err)
+	assert.True(t, tunnel.dialed)
+	assertStageError(t, tunnel.requestError(err), StageConnect, CodeConnectionRefused)
+}
+
+func TestDialServerTriesEachAddress(t *testing.T) {
+	ips, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", "localhost")
+	require.NoError(t, err)
+	if !slices.ContainsFunc(ips, netip.Addr.Is4) || !slices.ContainsFunc(ips, netip.Addr.Is6) {
+		t.Skip("localhost does not resolve to both loopback addresses")
+	}
+	// Only the IPv4 loopback listens, the IPv6 one refuses the connection.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tunnel := &tunnelState{}
+	c, err := dialServer(ctx, net.JoinHostPort("localhost", port), tunnel)
+	require.NoError(t, err)
+	defer func() { _ = c.Close() }()
+	assert.Equal(t, l.Addr().String(), c.RemoteAddr().String())
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	v4a, v4b := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	v6a, v6b := netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2")
+
+	assert.Equal(t, []netip.Addr{v6a, v4a, v6b, v4b}, interleaveFamilies([]netip.Addr{v6a, v6b, v4a, v4b}))
+	assert.Equal(t, []netip.Addr{v4a, v6a, v4b}, interleaveFamilies([]netip.Addr{v4a, v4b, v6a}))
+	assert.Equal(t, []netip.Addr{v4a, v4b}, interleaveFamilies([]netip.Addr{v4a, v4b}))
+}
+
+func TestPartialDeadline(t *testing.T) {
+	now := time.Now()
+
+	assert.Equal(t, now.Add(5*time.Second), partialDeadline(now, now.Add(10*time.Second), 2))
+	assert.Equal(t, now.Add(minDialAttempt), partialDeadline(now, now.Add(5*time.Second), 4))
+	assert.Equal(t, now.Add(time.Second), partialDeadline(now, now.Add(time.Second), 1))
+}
@@ -0,0 +1,388 @@
+package ssproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Kinds of target checks.
+const (
+	TargetHTTP = "http"
+	TargetTCP  = "tcp"
+	TargetDNS  = "dns"
+)
+
+const (
+	maxTargets = 10
+	// tcpTargetWait is how long a TCP target check waits for the server to close
+	// the connection, which is how shadowsocks servers report that they could
+	// not reach the target.
+	tcpTargetWait = 2 * time.Second
+	// defaultDNSTargetPort is the port dns checks without a resolver connect
+	// to.
+	defaultDNSTargetPort = 443
+)
+
+// errTargetClosed is returned by probeTarget when the server closes the
+// connection without data.
+var errTargetClosed = errors.New("the server closed the connection")
+
+// TargetCheck is a reachability check run through the tunnel.
+//   - http: GET URL, expecting ExpectedStatus or any 2xx/3xx status. Redirects
+//     are not followed, their status and Location are reported.
+//   - tcp: connect to Address (host:port).
+//   - dns: connect to Host on Port (443 by default) with the name in the
+//     request, so the server resolves it like it does for its users. With a
+//     Resolver, the name is instead resolved with a DNS query sent over TCP
+//     through the tunnel to that DNS server, which returns the addresses.
+type TargetCheck struct {
+	Kind           string `json:"kind"`
+	URL            string `json:"url,omitempty"`
+	ExpectedStatus int    `json:"expected_status,omitempty"`
+	Address        string `json:"address,omitempty"`
+	Host           string `json:"host,omitempty"`
+	Port           int    `json:"port,omitempty"`
+	Resolver       string `json:"resolver,omitempty"`
+}
+
+// TargetResult is the outcome of a TargetCheck. TLSValid is only set for https
+// URLs, Location for redirects and Addresses only for dns checks with a
+// resolver.
+type TargetResult struct {
+	Kind       string   `json:"kind"`
+	Target     string   `json:"target"`
+	Success    bool     `json:"success"`
+	StatusCode int      `json:"status_code,omitempty"`
+	Location   string   `json:"location,omitempty"`
+	Latency    float64  `json:"latency_ms,omitempty"`
+	TLSValid   *bool    `json:"tls_valid,omitempty"`
+	Addresses  []string `json:"addresses,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// checkTargets runs the checks concurrently, each in its own connection
+// through the server, and returns the results in the same order.
+func checkTargets(ctx context.Context, dialer *shadowDialer, checks []TargetCheck, timeout time.Duration) []TargetResult {
+	results := make([]TargetResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		if i >= maxTargets {
+			results[i] = TargetResult{Kind: check.Kind, Error: fmt.Sprintf("only %d targets can be checked", maxTargets)}
+			continue
+		}
+		wg.Go(func() {
+			results[i] = checkTarget(ctx, dialer, check, timeout)
+		})
+	}
+	wg.Wait()
+	return results
+}
+
+func checkTarget(ctx context.Context, dialer *shadowDialer, check TargetCheck, timeout time.Duration) TargetResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var result TargetResult
+	var err error
+	switch check.Kind {
+	case TargetHTTP:
+		result, err = checkHTTPTarget(ctx, dialer, check, timeout)
+	case TargetTCP:
+		result, err = checkTCPTarget(ctx, dialer, check)
+	case TargetDNS:
+		result, err = checkDNSTarget(ctx, dialer, check)
+	default:
+		err = fmt.Errorf("unknown target kind %q", check.Kind)
+	}
+	result.Kind = check.Kind
+	if err != nil {
+		result.Success = false
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func checkHTTPTarget(ctx context.Context, dialer *shadowDialer, check TargetCheck, timeout time.Duration) (TargetResult, error) {
+	result := TargetResult{Target: check.URL}
+	u, err := url.Parse(check.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return result, fmt.Errorf("invalid target URL %q", check.URL)
+	}
+
+	// The certificate is verified by hand so the status code is still
+	// reported when it is not valid.
+	var tlsErr error
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			tlsErr = verifyConnection(state)
+			return nil
+		},
+	}
+	httpClient, _, closeTunnel, err := dialer.httpClient(ctx, timeout, timeout, tlsConfig)
+	if err != nil {
+		return result, err
+	}
+	defer closeTunnel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, check.URL, nil)
+	if err != nil {
+		return result, err
+	}
+	request.Header.Set("User-Agent", "ShadowTest")
+	start := time.Now()
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return result, err
+	}
+	defer func() {
+		closeErr := response.Body.Close()
+		if closeErr != nil {
+			log.Errorf("failed to close response body: %v", closeErr)
+			sentry.CaptureException(closeErr)
+		}
+	}()
+	result.Latency = milliseconds(time.Since(start))
+	result.StatusCode = response.StatusCode
+	result.Location = response.Header.Get("Location")
+
+	if u.Scheme == "https" {
+		valid := tlsErr == nil
+		result.TLSValid = &valid
+		if tlsErr != nil {
+			return result, fmt.Errorf("invalid certificate: %w", tlsErr)
+		}
+	}
+	if check.ExpectedStatus != 0 && response.StatusCode != check.ExpectedStatus {
+		return result, fmt.Errorf("unexpected status %d, expected %d", response.StatusCode, check.ExpectedStatus)
+	}
+	if check.ExpectedStatus == 0 && (response.StatusCode < 200 || response.StatusCode > 399) {
+		return result, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	result.Success = true
+	return result, nil
+}
+
+// verifyConnection verifies the certificate chain of a TLS connection against
+// the system roots, like crypto/tls does by default.
+func verifyConnection(state tls.ConnectionState) error {
+	return verifyChain(state.PeerCertificates, state.ServerName, nil)
+}
+
+// verifyChain verifies a certificate chain as sent by a server against roots,
+// or the system roots when it is nil.
+func verifyChain(certificates []*x509.Certificate, serverName string, roots *x509.CertPool) error {
+	if len(certificates) == 0 {
+		return errors.New("no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certificates[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Intermediates: intermediates,
+		Roots:         roots,
+	})
+	return err
+}
+
+// dialTarget connects to address through the tunnel.
+func dialTarget(ctx context.Context, dialer *shadowDialer, address string) (net.Conn, func(), error) {
+	deadline, _ := ctx.Deadline()
+	socksDialer, _, closeTunnel, err := dialer.socksDialer(ctx, time.Until(deadline))
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := socksDialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		closeTunnel()
+		return nil, nil, err
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		closeTunnel()
+		return nil, nil, err
+	}
+	return conn, func() {
+		_ = conn.Close()
+		closeTunnel()
+	}, nil
+}
+
+// probeTarget connects to address through the tunnel. Shadowsocks does not
+// report whether the server reached the target: the connection is considered
+// open when the target sends data, in which case the time until then is
+// returned, or when the server keeps it open for tcpTargetWait. A closed
+// connection, errTargetClosed, does not tell why, the server may have failed to
+// reach the target or refused the request, even though the tunnel worked for
+// the exit lookup.
+func probeTarget(ctx context.Context, dialer *shadowDialer, address string) (time.Duration, error) {
+	start := time.Now()
+	conn, closeConn, err := dialTarget(ctx, dialer, address)
+	if err != nil {
+		return 0, err
+	}
+	defer closeConn()
+
+	wait := time.Now().Add(tcpTargetWait)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(wait) {
+		wait = deadline
+	}
+	if err := conn.SetReadDeadline(wait); err != nil {
+		return 0, err
+	}
+	_, err = conn.Read(make([]byte, 1))
+	switch {
+	case err == nil:
+		return time.Since(start), nil
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return 0, nil
+	case errors.Is(err, io.EOF):
+		return 0, errTargetClosed
+	default:
+		return 0, err
+	}
+}
+
+func checkTCPTarget(ctx context.Context, dialer *shadowDialer, check TargetCheck) (TargetResult, error) {
+	result := TargetResult{Target: check.Address}
+	if _, _, err := net.SplitHostPort(check.Address); err != nil {
+		return result, fmt.Errorf("invalid target address %q", check.Address)
+	}
+
+	latency, err := probeTarget(ctx, dialer, check.Address)
+	if errors.Is(err, errTargetClosed) {
+		return result, fmt.Errorf("%w: the target is unreachable from the server, or the server refused the request", err)
+	}
+	if err != nil {
+		return result, err
+	}
+	result.Latency = milliseconds(latency)
+	result.Success = true
+	return result, nil
+}
+
+func checkDNSTarget(ctx context.Context, dialer *shadowDialer, check TargetCheck) (TargetResult, error) {
+	result := TargetResult{Target: check.Host}
+	host := check.Host
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	name, err := dnsmessage.NewName(host)
+	if _, ipErr := netip.ParseAddr(check.Host); err != nil || ipErr == nil || check.Host == "" {
+		return result, fmt.Errorf("invalid target host %q", check.Host)
+	}
+	if check.Resolver != "" {
+		return resolveTargetThroughTunnel(ctx, dialer, check, name)
+	}
+
+	port := check.Port
+	if port == 0 {
+		port = defaultDNSTargetPort
+	}
+	if port < 0 || port > 65535 {
+		return result, fmt.Errorf("invalid target port %d", port)
+	}
+	latency, err := probeTarget(ctx, dialer, net.JoinHostPort(check.Host, strconv.Itoa(port)))
+	if errors.Is(err, errTargetClosed) {
+		return result, fmt.Errorf("%w: the host does not resolve or is unreachable from the server, or the server refused the request", err)
+	}
+	if err != nil {
+		return result, err
+	}
+	result.Latency = milliseconds(latency)
+	result.Success = true
+	return result, nil
+}
+
+// resolveTargetThroughTunnel resolves name with the DNS server of the check,
+// reached through the tunnel.
+func resolveTargetThroughTunnel(ctx context.Context, dialer *shadowDialer, check TargetCheck, name dnsmessage.Name) (TargetResult, error) {
+	result := TargetResult{Target: check.Host}
+	start := time.Now()
+	conn, closeConn, err := dialTarget(ctx, dialer, check.Resolver)
+	if err != nil {
+		return result, err
+	}
+	defer closeConn()
+
+	addresses, err := resolveOverTCP(conn, name)
+	if err != nil {
+		return result, err
+	}
+	result.Latency = milliseconds(time.Since(start))
+	result.Addresses = addresses
+	result.Success = true
+	return result, nil
+}
+
+// resolveOverTCP sends A and AAAA queries for name on conn, using the DNS over
+// TCP framing, and returns the addresses of both answers.
+func resolveOverTCP(conn net.Conn, name dnsmessage.Name) ([]string, error) {
+	var addresses []string
+	for i, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		id := uint16(i + 1)
+		query := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+		}
+		packed, err := query.AppendPack(make([]byte, 2, 514))
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint16(packed, uint16(len(packed)-2))
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		answer := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, answer); err != nil {
+			return nil, err
+		}
+		var response dnsmessage.Message
+		if err := response.Unpack(answer); err != nil {
+			return nil, err
+		}
+		if response.ID != id {
+			return nil, errors.New("unexpected DNS answer")
+		}
+		if response.RCode != dnsmessage.RCodeSuccess {
+			return nil, fmt.Errorf("DNS query failed: %s", response.RCode)
+		}
+		for _, resource := range response.Answers {
+			switch body := resource.Body.(type) {
+			case *dnsmessage.AResource:
+				addresses = append(addresses, net.IP(body.A[:]).String())
+			case *dnsmessage.AAAAResource:
+				addresses = append(addresses, net.IP(body.AAAA[:]).String())
+			}
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", name)
+	}
+	return addresses, nil
+}
@@ -0,0 +1,156 @@
+package ssproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveDNSOverTCP answers A queries with 192.0.2.1 and any other query with
+// an empty answer.
+func serveDNSOverTCP(c net.Conn) {
+	for {
+		var length [2]byte
+		if _, err := io.ReadFull(c, length[:]); err != nil {
+			return
+		}
+		packet := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(c, packet); err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(packet); err != nil {
+			return
+		}
+		query.Header.Response = true
+		if query.Questions[0].Type == dnsmessage.TypeA {
+			query.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			}}
+		}
+		answer, err := query.AppendPack(make([]byte, 2))
+		if err != nil {
+			return
+		}
+		binary.BigEndian.PutUint16(answer, uint16(len(answer)-2))
+		if _, err := c.Write(answer); err != nil {
+			return
+		}
+	}
+}
+
+func TestCheckTargets(t *testing.T) {
+	dialer := newTestDialer(t)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer httpServer.Close()
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+	bannerAddr := startTCPServer(t, func(c net.Conn) { _, _ = c.Write([]byte("SSH-2.0-test\r\n")) })
+	resolverAddr := startTCPServer(t, serveDNSOverTCP)
+
+	unreachable, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unreachableAddr := unreachable.Addr().String()
+	require.NoError(t, unreachable.Close())
+
+	results := checkTargets(context.Background(), dialer, []TargetCheck{
+		{Kind: TargetHTTP, URL: httpServer.URL},
+		{Kind: TargetHTTP, URL: httpServer.URL + "/missing", ExpectedStatus: http.StatusNotFound},
+		{Kind: TargetHTTP, URL: httpServer.URL + "/missing"},
+		{Kind: TargetHTTP, URL: tlsServer.URL},
+		{Kind: TargetTCP, Address: bannerAddr},
+		{Kind: TargetTCP, Address: unreachableAddr},
+		{Kind: TargetDNS, Host: "example.com", Resolver: resolverAddr},
+		{Kind: "ping", Address: bannerAddr},
+		{Kind: TargetDNS, Host: "localhost", Port: tcpPort(t, bannerAddr)},
+		{Kind: TargetDNS, Host: "localhost", Port: tcpPort(t, unreachableAddr)},
+	}, 5*time.Second)
+	require.Len(t, results, 10)
+
+	assert.True(t, results[0].Success, results[0].Error)
+	assert.Equal(t, http.StatusOK, results[0].StatusCode)
+	assert.Greater(t, results[0].Latency, 0.0)
+	assert.Nil(t, results[0].TLSValid)
+
+	assert.True(t, results[1].Success, results[1].Error)
+	assert.Equal(t, http.StatusNotFound, results[1].StatusCode)
+
+	assert.False(t, results[2].Success)
+	assert.Equal(t, "unexpected status 404", results[2].Error)
+
+	assert.False(t, results[3].Success)
+	assert.Equal(t, http.StatusOK, results[3].StatusCode)
+	require.NotNil(t, results[3].TLSValid)
+	assert.False(t, *results[3].TLSValid)
+	assert.Contains(t, results[3].Error, "invalid certificate")
+
+	assert.True(t, results[4].Success, results[4].Error)
+	assert.Equal(t, bannerAddr, results[4].Target)
+
+	assert.False(t, results[5].Success)
+	assert.Contains(t, results[5].Error, "unreachable")
+
+	assert.True(t, results[6].Success, results[6].Error)
+	assert.Equal(t, []string{"192.0.2.1"}, results[6].Addresses)
+
+	assert.Equal(t, `unknown target kind "ping"`, results[7].Error)
+
+	assert.True(t, results[8].Success, results[8].Error)
+	assert.Empty(t, results[8].Addresses)
+
+	assert.False(t, results[9].Success)
+	assert.Contains(t, results[9].Error, "does not resolve")
+}
+
+func TestCheckDNSTargetRequiresName(t *testing.T) {
+	_, err := checkDNSTarget(context.Background(), nil, TargetCheck{Kind: TargetDNS, Host: "127.0.0.1"})
+	assert.EqualError(t, err, `invalid target host "127.0.0.1"`)
+}
+
+func TestCheckHTTPTargetRedirect(t *testing.T) {
+	dialer := newTestDialer(t)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+		}
+	}))
+	defer httpServer.Close()
+
+	start := time.Now()
+	results := checkTargets(context.Background(), dialer, []TargetCheck{
+		{Kind: TargetHTTP, URL: httpServer.URL + "/old"},
+		{Kind: TargetHTTP, URL: httpServer.URL + "/old", ExpectedStatus: http.StatusOK},
+	}, 5*time.Second)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	assert.True(t, results[0].Success, results[0].Error)
+	assert.Equal(t, http.StatusMovedPermanently, results[0].StatusCode)
+	assert.Equal(t, "/new", results[0].Location)
+
+	assert.False(t, results[1].Success)
+	assert.Equal(t, "unexpected status 301, expected 200", results[1].Error)
+}
+
+func TestCheckTargetsLimit(t *testing.T) {
+	checks := make([]TargetCheck, maxTargets+1)
+	for i := range checks {
+		checks[i] = TargetCheck{Kind: TargetTCP, Address: "invalid"}
+	}
+	results := checkTargets(context.Background(), nil, checks, time.Second)
+	assert.Equal(t, `invalid target address "invalid"`, results[0].Error)
+	assert.Equal(t, "only 10 targets can be checked", results[maxTargets].Error)
+}
@@ -0,0 +1,242 @@
+package ssproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+)
+
+// tunnelState records how far the connection to the server got, so a failed
+// request through the local proxy can be attributed to the right stage.
+type tunnelState struct {
+	mu          sync.Mutex
+	dialed      bool
+	dialErr     error
+	dns         time.Duration
+	connect     time.Duration
+	serverBytes int64
+	serverErr   error
+	// onConnect receives the IP the tunnel connected to.
+	onConnect func(netip.Addr)
+}
+
+// setDialed records the result and the durations of dialing the server.
+func (s *tunnelState) setDialed(dns, connect time.Duration, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dialed = true
+	s.dialErr = err
+	s.dns = dns
+	s.connect = connect
+}
+
+// connected records the address the tunnel connected to.
+func (s *tunnelState) connected(addr net.Addr) {
+	if s == nil || s.onConnect == nil {
+		return
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		s.onConnect(tcpAddr.AddrPort().Addr().Unmap())
+	}
+}
+
+// dialDurations returns how long resolving and connecting to the server took.
+func (s *tunnelState) dialDurations() (time.Duration, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dns, s.connect
+}
+
+// wrap counts the bytes received from the server and remembers the first
+// error reading them, like a failed authentication of the response.
+func (s *tunnelState) wrap(c net.Conn) net.Conn {
+	if s == nil {
+		return c
+	}
+	return &trackedConn{Conn: c, state: s}
+}
+
+// requestError classifies the error of the request sent through the tunnel.
+func (s *tunnelState) requestError(err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var netErr net.Error
+	timeout := errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+	switch {
+	case s.dialErr != nil:
+		return dialError(s.dialErr)
+	case !s.dialed:
+		return dialError(err)
+	case s.serverErr != nil:
+		return newStageError(StageHandshake, CodeAuthFailed, fmt.Errorf("%w: %v", err, s.serverErr))
+	case s.serverBytes == 0 && timeout:
+		return newStageError(StageHandshake, CodeHandshakeTimeout, err)
+	case s.serverBytes == 0:
+		return newStageError(StageHandshake, CodeAuthFailed, err)
+	case timeout:
+		return newStageError(StageUpstream, CodeUpstreamTimeout, err)
+	default:
+		return newStageError(StageUpstream, CodeUpstreamFailed, err)
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	state *tunnelState
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	c.state.serverBytes += int64(n)
+	var netErr net.Error
+	if err != nil && c.state.serverErr == nil && !errors.Is(err, net.ErrClosed) && !errors.As(err, &netErr) &&
+		!errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		c.state.serverErr = err
+	}
+	return n, err
+}
+
+// shadowDialer connects to the server of a key through its plugin and cipher.
+type shadowDialer struct {
+	serverAddr string
+	shadow     func(net.Conn) net.Conn
+	// stop releases the plugin resources and must always be called.
+	stop func()
+	// host is the server host of the key and direct is false when
+	// serverAddr is the local address of an external plugin.
+	host   string
+	direct bool
+
+	mu     sync.Mutex
+	remote netip.Addr
+	// connected is closed once remote is set.
+	connected chan struct{}
+}
+
+// newShadowDialer picks the cipher and starts the plugin of the key. Errors are
+// returned as a *StageError.
+func newShadowDialer(ctx context.Context, key Key) (*shadowDialer, error) {
+	ciph, err := pickCipher(key)
+	if err != nil {
+		return nil, cipherError(err)
+	}
+	serverAddr, wrap, stopPlugin, err := setupPlugin(ctx, key)
+	if err != nil {
+		return nil, withStage(StageConnect, CodePluginFailed, err)
+	}
+	shadow := ciph.StreamConn
+	if wrap != nil {
+		shadow = func(c net.Conn) net.Conn { return ciph.StreamConn(wrap(c)) }
+	}
+	return &shadowDialer{
+		serverAddr: serverAddr,
+		shadow:     shadow,
+		stop:       stopPlugin,
+		host:       key.Host,
+		direct:     serverAddr == key.Addr(),
+		connected:  make(chan struct{}),
+	}, nil
+}
+
+func (d *shadowDialer) setRemote(ip netip.Addr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.remote.IsValid() {
+		close(d.connected)
+	}
+	d.remote = ip
+}
+
+// entryIP returns the IP of the server the tunnels connected to, waiting for
+// the first connection until ctx is done. Through an external plugin that IP is
+// unknown, so the host of the key is resolved instead.
+func (d *shadowDialer) entryIP(ctx context.Context) (netip.Addr, error) {
+	if d.direct {
+		select {
+		case <-d.connected:
+		case <-ctx.Done():
+			return netip.Addr{}, errors.New("the server was never connected")
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.remote, nil
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", d.host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return ips[0].Unmap(), nil
+}
+
+// socksDialer starts a local SOCKS proxy forwarding one connection to the
+// server. It returns the dialer to use, the state of that tunnel and a function
+// closing it, which must always be called.
+func (d *shadowDialer) socksDialer(ctx context.Context, relayTimeout time.Duration) (proxy.ContextDialer, *tunnelState, func(), error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, nil, newStageError(StageConnect, CodeConnectFailed, err)
+	}
+	closeListener := func() {
+		err := l.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Errorf("failed to close listener: %v", err)
+		}
+	}
+	proxyAddr := l.Addr().String()
+
+	tunnel := &tunnelState{onConnect: d.setRemote}
+	go listenForOneConnection(ctx, l, d.serverAddr, d.shadow, func(c net.Conn) (socks.Addr, error) { return socks.Handshake(c) }, tunnel, relayTimeout)
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr, nil, proxy.Direct)
+	if err != nil {
+		closeListener()
+		return nil, nil, nil, newStageError(StageConnect, CodeConnectFailed, err)
+	}
+	return dialer.(proxy.ContextDialer), tunnel, closeListener, nil
+}
+
+// httpClient returns a client sending one request through the tunnel, using
+// tlsConfig when it is not nil, the state of that tunnel and a function closing
+// it, which must always be called. Redirects are returned as they are, as the
+// tunnel only carries one connection.
+func (d *shadowDialer) httpClient(ctx context.Context, timeout, relayTimeout time.Duration, tlsConfig *tls.Config) (*http.Client, *tunnelState, func(), error) {
+	dialer, tunnel, closeTunnel, err := d.socksDialer(ctx, relayTimeout)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	httpTransport := &http.Transport{
+		DisableKeepAlives: true,
+		TLSClientConfig:   tlsConfig,
+	}
+	httpClient := &http.Client{
+		Transport: httpTransport,
+		Timeout:   timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	httpTransport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return httpClient, tunnel, func() {
+		httpTransport.CloseIdleConnections()
+		closeTunnel()
+	}, nil
+}
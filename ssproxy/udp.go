@@ -0,0 +1,171 @@
+package ssproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// DefaultUDPDNSServer is the DNS server queried through the UDP relay when
+	// no echo target is configured.
+	DefaultUDPDNSServer = "1.1.1.1:53"
+	udpCheckDNSName     = "example.com."
+	udpCheckEchoSize    = 32
+	udpMaxPacketSize    = 64 * 1024
+)
+
+// UDPOptions configures the UDP relay check. By default a DNS query is sent to
+// DefaultUDPDNSServer; with Echo the datagram is sent to Target, which has to
+// answer with the same bytes.
+type UDPOptions struct {
+	Target string `json:"target,omitempty"`
+	Echo   bool   `json:"echo,omitempty"`
+}
+
+// UDPResult is the outcome of the UDP relay check, independent from the TCP
+// test result.
+type UDPResult struct {
+	Success bool    `json:"success"`
+	RTT     float64 `json:"rtt_ms,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// milliseconds converts a duration to fractional milliseconds for results.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// checkUDP sends one datagram through the UDP relay of the server at serverIP,
+// the address the TCP tests connected to, and waits for the answer. Plugins
+// only carry TCP, so the datagram goes straight to the server like shadowsocks
+// clients do.
+func checkUDP(ctx context.Context, key Key, serverIP netip.Addr, options UDPOptions, timeout time.Duration) *UDPResult {
+	rtt, err := relayUDP(ctx, key, serverIP, options, timeout)
+	if err != nil {
+		log.Infof("UDP check failed for %s: %v", key.Addr(), err)
+		return &UDPResult{Error: err.Error()}
+	}
+	return &UDPResult{Success: true, RTT: milliseconds(rtt)}
+}
+
+func relayUDP(ctx context.Context, key Key, serverIP netip.Addr, options UDPOptions, timeout time.Duration) (time.Duration, error) {
+	if isSIP022Cipher(key.Cipher) {
+		return 0, fmt.Errorf("UDP is not supported for %s", key.Cipher)
+	}
+	ciph, err := core.PickCipher(key.Cipher, []byte{}, key.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	target := options.Target
+	if target == "" {
+		if options.Echo {
+			return 0, errors.New("missing UDP echo target")
+		}
+		target = DefaultUDPDNSServer
+	}
+	targetAddr := socks.ParseAddr(target)
+	if targetAddr == nil {
+		return 0, fmt.Errorf("invalid UDP target %s", target)
+	}
+
+	payload, check, err := udpCheckPayload(options.Echo)
+	if err != nil {
+		return 0, err
+	}
+
+	serverAddr := net.UDPAddrFromAddrPort(netip.AddrPortFrom(serverIP, uint16(key.Port)))
+
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		err := pc.Close()
+		if err != nil {
+			log.Errorf("failed to close UDP socket: %v", err)
+		}
+	}()
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := pc.SetDeadline(deadline); err != nil {
+		return 0, err
+	}
+	stop := context.AfterFunc(ctx, func() { _ = pc.SetDeadline(time.Now()) })
+	defer stop()
+
+	spc := ciph.PacketConn(pc)
+	start := time.Now()
+	if _, err := spc.WriteTo(append(targetAddr, payload...), serverAddr); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		// Datagrams that do not decrypt or are not the answer are ignored
+		// until the deadline.
+		n, _, err := spc.ReadFrom(buf)
+		var netErr net.Error
+		if errors.As(err, &netErr) || errors.Is(err, net.ErrClosed) {
+			return 0, err
+		}
+		if err != nil {
+			continue
+		}
+		from := socks.SplitAddr(buf[:n])
+		if from == nil {
+			continue
+		}
+		if check(buf[len(from):n]) {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// udpCheckPayload returns the datagram to send and a function checking the
+// answer: a random string expected back from an echo target or a DNS query.
+func udpCheckPayload(echo bool) ([]byte, func([]byte) bool, error) {
+	if echo {
+		payload := make([]byte, udpCheckEchoSize)
+		if _, err := rand.Read(payload); err != nil {
+			return nil, nil, err
+		}
+		return payload, func(answer []byte) bool { return bytes.Equal(answer, payload) }, nil
+	}
+
+	idBytes := make([]byte, 2)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, nil, err
+	}
+	id := uint16(idBytes[0])<<8 | uint16(idBytes[1])
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(udpCheckDNSName),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	payload, err := query.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return payload, func(answer []byte) bool {
+		var parser dnsmessage.Parser
+		header, err := parser.Start(answer)
+		return err == nil && header.ID == id && header.Response
+	}, nil
+}
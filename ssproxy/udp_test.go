@@ -0,0 +1,168 @@
+package ssproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startUDPServer answers every datagram with the result of handle.
+func startUDPServer(t *testing.T, handle func([]byte) []byte) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, udpMaxPacketSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(handle(buf[:n]), addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// startUDPRelay runs the UDP side of a shadowsocks server, forwarding one
+// datagram at a time to its target.
+func startUDPRelay(t *testing.T, cipher, password string) Key {
+	ciph, err := core.PickCipher(cipher, []byte{}, password)
+	require.NoError(t, err)
+	aeadCipher := ciph.(shadowaead.Cipher)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = pc.Close() })
+
+	go func() {
+		buf := make([]byte, udpMaxPacketSize)
+		for {
+			n, client, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			packet, err := openUDPPacket(aeadCipher, buf[:n])
+			if err != nil {
+				continue
+			}
+			target := socks.SplitAddr(packet)
+			if target == nil {
+				continue
+			}
+			targetAddr, err := net.ResolveUDPAddr("udp", target.String())
+			if err != nil {
+				continue
+			}
+			conn, err := net.DialUDP("udp", nil, targetAddr)
+			if err != nil {
+				continue
+			}
+			_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+			_, _ = conn.Write(packet[len(target):])
+			answer := make([]byte, udpMaxPacketSize)
+			m, err := conn.Read(answer)
+			_ = conn.Close()
+			if err != nil {
+				continue
+			}
+			reply, err := sealUDPPacket(aeadCipher, append(append([]byte{}, target...), answer[:m]...))
+			if err != nil {
+				continue
+			}
+			_, _ = pc.WriteTo(reply, client)
+		}
+	}()
+
+	addr := pc.LocalAddr().(*net.UDPAddr)
+	return Key{Host: "127.0.0.1", Port: addr.Port, Cipher: cipher, Password: password}
+}
+
+// openUDPPacket and sealUDPPacket work like shadowaead.Unpack and
+// shadowaead.Pack without the process wide salt filter, which would otherwise
+// reject the salts of the client running in the same process.
+func openUDPPacket(ciph shadowaead.Cipher, packet []byte) ([]byte, error) {
+	if len(packet) < ciph.SaltSize() {
+		return nil, shadowaead.ErrShortPacket
+	}
+	aead, err := ciph.Decrypter(packet[:ciph.SaltSize()])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, aead.NonceSize()), packet[ciph.SaltSize():], nil)
+}
+
+func sealUDPPacket(ciph shadowaead.Cipher, payload []byte) ([]byte, error) {
+	salt := make([]byte, ciph.SaltSize())
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := ciph.Encrypter(salt)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(salt, make([]byte, aead.NonceSize()), payload, nil), nil
+}
+
+func TestCheckUDPEcho(t *testing.T) {
+	key := startUDPRelay(t, "chacha20-ietf-poly1305", "secret")
+	target := startUDPServer(t, func(b []byte) []byte { return b })
+
+	result := checkUDP(context.Background(), key, netip.MustParseAddr(key.Host), UDPOptions{Target: target, Echo: true}, 5*time.Second)
+	assert.True(t, result.Success, result.Error)
+	assert.Greater(t, result.RTT, 0.0)
+}
+
+func TestCheckUDPDNS(t *testing.T) {
+	key := startUDPRelay(t, "aes-256-gcm", "secret")
+	target := startUDPServer(t, func(b []byte) []byte {
+		var query dnsmessage.Message
+		if err := query.Unpack(b); err != nil {
+			return nil
+		}
+		query.Header.Response = true
+		answer, _ := query.Pack()
+		return answer
+	})
+
+	result := checkUDP(context.Background(), key, netip.MustParseAddr(key.Host), UDPOptions{Target: target}, 5*time.Second)
+	assert.True(t, result.Success, result.Error)
+}
+
+func TestCheckUDPWrongAnswer(t *testing.T) {
+	key := startUDPRelay(t, "aes-128-gcm", "secret")
+	target := startUDPServer(t, func(b []byte) []byte { return []byte("something else") })
+
+	result := checkUDP(context.Background(), key, netip.MustParseAddr(key.Host), UDPOptions{Target: target, Echo: true}, 500*time.Millisecond)
+	assert.False(t, result.Success)
+	assert.NotEmpty(t, result.Error)
+}
+
+func TestCheckUDPWrongPassword(t *testing.T) {
+	key := startUDPRelay(t, "aes-128-gcm", "secret")
+	target := startUDPServer(t, func(b []byte) []byte { return b })
+	key.Password = "wrong"
+
+	result := checkUDP(context.Background(), key, netip.MustParseAddr(key.Host), UDPOptions{Target: target, Echo: true}, 500*time.Millisecond)
+	assert.False(t, result.Success)
+}
+
+func TestCheckUDPUnsupported(t *testing.T) {
+	key := Key{Host: "127.0.0.1", Port: 8388, Cipher: "2022-blake3-aes-128-gcm", Password: randomPSK(t, 16)}
+	result := checkUDP(context.Background(), key, netip.MustParseAddr(key.Host), UDPOptions{}, time.Second)
+	assert.False(t, result.Success)
+	assert.Contains(t, result.Error, "not supported")
+
+	key = Key{Host: "127.0.0.1", Port: 8388, Cipher: "aes-128-gcm", Password: "secret"}
+	result = checkUDP(context.Background(), key, netip.MustParseAddr(key.Host), UDPOptions{Echo: true}, time.Second)
+	assert.Equal(t, "missing UDP echo target", result.Error)
+}